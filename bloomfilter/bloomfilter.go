@@ -0,0 +1,77 @@
+package bloomfilter
+
+// bloomfilter 模块实现了布隆过滤器
+// 用于快速判断一个key是否一定不存在 存在误判(不存在的key被判为可能存在) 但不会漏判
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Filter 是并发安全的布隆过滤器 Add和Has可以并发调用
+type Filter struct {
+	bits []uint64 // 位数组 按uint64分组以便原子操作
+	m    uint64   // 位数
+	k    uint64   // 哈希函数个数
+}
+
+// New 创建预计存放n个key 误判率为p的布隆过滤器
+// 位数 m = -n*ln(p)/(ln2)^2 哈希函数个数 k = m/n*ln2
+func New(n int, p float64) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Filter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// hash 计算key的FNV-1a哈希 拆成两个32位的值用于双重哈希
+func hash(key string) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h & 0xffffffff, h>>32 | 1
+}
+
+// Add 添加一个key
+func (f *Filter) Add(key string) {
+	h1, h2 := hash(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		word, mask := &f.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// Has 判断key是否可能存在 返回false时key一定没有被Add过
+func (f *Filter) Has(key string) bool {
+	h1, h2 := hash(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if atomic.LoadUint64(&f.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,28 @@
+package bloomfilter
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.Has(strconv.Itoa(i)) {
+			t.Fatalf("added key %d should always be found", i)
+		}
+	}
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if f.Has(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	// 期望误判率1% 留出余量
+	if falsePositives > 300 {
+		t.Fatalf("false positive rate too high: %d/10000", falsePositives)
+	}
+}
@@ -1,5 +1,11 @@
 package simplegroupcache
 
+import (
+	"time"
+
+	cachestrategy "simple-groupcache/cache-strategy"
+)
+
 // byteview 模块定义读取缓存结果
 // 实际上 byteview 只是简单的封装了byte slice，让其只读。
 // 试想一下，直接返回slice，在golang里，一切参数按值传递。
@@ -9,7 +15,17 @@ package simplegroupcache
 // 可以被恶意修改。因此需要将slice封装成只读的ByteView
 
 type ByteView struct {
-	b []byte
+	b       []byte
+	version int64 // 数据源给出的版本号
+
+	// stale 之后值变旧 Get仍返回它但会在后台刷新 零值表示不会变旧
+	// expire 之后值过期 只在重新加载失败时才返回它 零值表示永不过期
+	// 缓存策略中的过期时间是expire再加上stale-if-error窗口
+	stale  time.Time
+	expire time.Time
+	delta  time.Duration // 从数据源加载这个值所用的时间 用于提前刷新
+	// noStore 为true表示数据源要求不缓存这个值 所属节点将其转告给其他节点
+	noStore bool
 }
 
 func cloneBytes(bytes []byte) []byte {
@@ -32,3 +48,18 @@ func (v ByteView) ByteSlice() []byte {
 func (v ByteView) String() string {
 	return string(v.b)
 }
+
+// Version 返回数据源给出的版本号 数据源未提供时为0
+func (v ByteView) Version() int64 {
+	return v.version
+}
+
+// isStale 判断值在now时是否已变旧
+func (v ByteView) isStale(now time.Time) bool {
+	return cachestrategy.Expired(v.stale, now)
+}
+
+// isExpired 判断值在now时是否已过期
+func (v ByteView) isExpired(now time.Time) bool {
+	return cachestrategy.Expired(v.expire, now)
+}
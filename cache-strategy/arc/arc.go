@@ -1,34 +1,63 @@
 package arc
 
 import (
+	"time"
+
 	cachestrategy "simple-groupcache/cache-strategy"
 	"simple-groupcache/cache-strategy/lfu"
 	"simple-groupcache/cache-strategy/lru"
 )
 
+// Cache 是ARC算法实现的缓存
+// lru保存只访问过一次的数据 lfu保存访问过多次的数据
+// ghostLru/ghostLfu分别记录最近从lru/lfu淘汰的key 只保存key和大小 不保存value
+// 命中ghost说明对应的那一侧容量偏小 据此调整part
 type Cache struct {
-	maxByte  int64
-	part     int64 // lru和ghostLru占用字节数的偏好值, 越大表示更倾向于保留初次访问的数据
-	lru      *lru.Cache
-	ghostLru *lru.Cache
-	lfu      *lfu.Cache
-	ghostLfu *lfu.Cache
+	maxByte        int64
+	maxEntries     int64 // 最大条目数 0表示不限制
+	chargeOverhead bool  // 容量检查时是否计入每条缓存的结构开销
+	part           int64 // lru占用字节数的目标值, 越大表示更倾向于保留初次访问的数据
+	lru            *lru.Cache
+	ghostLru       *ghost
+	lfu            *lfu.Cache
+	ghostLfu       *ghost
 
 	callback cachestrategy.OnEvicted
 }
 
 var _ cachestrategy.CacheStrategy = (*Cache)(nil)
 
+func init() {
+	cachestrategy.Register("arc", func(maxBytes int64, callback cachestrategy.OnEvicted) cachestrategy.CacheStrategy {
+		return New(maxBytes, callback)
+	})
+}
+
 func New(maxByte int64, callback cachestrategy.OnEvicted) *Cache {
-	return &Cache{
+	c := &Cache{
 		maxByte:  maxByte,
 		part:     0,
-		lru:      lru.New(maxByte, nil),
-		ghostLru: lru.New(maxByte, nil),
-		lfu:      lfu.New(maxByte, nil),
-		ghostLfu: lfu.New(maxByte, nil),
+		ghostLru: newGhost(maxByte),
+		ghostLfu: newGhost(maxByte),
 		callback: callback,
 	}
+	c.lru = lru.New(maxByte, c.onSubEvicted)
+	c.lfu = lfu.New(maxByte, c.onSubEvicted)
+	return c
+}
+
+// onSubEvicted 是lru/lfu的回调 只转发淘汰和过期
+// 数据在lru和lfu之间移动也会经过Remove/Add 删除和替换由Cache自己回调
+func (c *Cache) onSubEvicted(key string, value cachestrategy.Lengthable, reason cachestrategy.EvictReason) {
+	if c.callback != nil && (reason == cachestrategy.EvictCapacity || reason == cachestrategy.EvictExpired) {
+		c.callback(key, value, reason)
+	}
+}
+
+// SetClock 设置判断过期所使用的时钟
+func (c *Cache) SetClock(clock cachestrategy.Clock) {
+	c.lru.SetClock(clock)
+	c.lfu.SetClock(clock)
 }
 
 // Len 返回当前缓存元素个数
@@ -36,11 +65,105 @@ func (c *Cache) Len() int64 {
 	return c.lru.Len() + c.lfu.Len()
 }
 
+// Bytes 返回当前缓存占用的字节数 ghost中的淘汰记录不计算在内
+func (c *Cache) Bytes() int64 {
+	return c.lru.CurrByte + c.lfu.CurrByte
+}
+
+// ResidentBytes 返回估计的实际内存占用 ghost中的淘汰记录只有key 但也占内存 一并计算
+func (c *Cache) ResidentBytes() int64 {
+	return c.lru.ResidentBytes() + c.lfu.ResidentBytes() +
+		c.ghostLru.residentBytes() + c.ghostLfu.residentBytes()
+}
+
+// SetLimits 设置容量上限 并立即淘汰超出部分
+func (c *Cache) SetLimits(limits cachestrategy.Limits) {
+	c.maxByte = limits.MaxBytes
+	c.maxEntries = limits.MaxEntries
+	c.chargeOverhead = limits.ChargeOverhead
+	c.lru.SetLimits(limits)
+	c.lfu.SetLimits(limits)
+	if c.part > c.maxByte {
+		c.part = c.maxByte
+	}
+	c.makeRoom("", 0, 0)
+	for _, g := range []*ghost{c.ghostLru, c.ghostLfu} {
+		g.maxBytes, g.maxEntries = limits.MaxBytes, limits.MaxEntries
+		for g.len() > 0 && ((g.maxBytes != 0 && g.bytes > g.maxBytes) ||
+			(g.maxEntries != 0 && g.len() > g.maxEntries)) {
+			g.evict()
+		}
+	}
+}
+
+// chargedBytes 返回容量检查时使用的字节数
+func (c *Cache) chargedBytes() int64 {
+	if c.chargeOverhead {
+		return c.lru.ResidentBytes() + c.lfu.ResidentBytes()
+	}
+	return c.Bytes()
+}
+
+// makeRoom 不断淘汰直到能再放下extraBytes字节/extraEntries条缓存
+func (c *Cache) makeRoom(key string, extraBytes, extraEntries int64) {
+	for c.Len() > 0 &&
+		((c.maxByte != 0 && c.chargedBytes()+extraBytes > c.maxByte) ||
+			(c.maxEntries != 0 && c.Len()+extraEntries > c.maxEntries)) {
+		c.replace(key)
+	}
+}
+
+// chargedSize 返回一条缓存在容量检查时的字节数
+func (c *Cache) chargedSize(key string, value cachestrategy.Lengthable) int64 {
+	size := int64(len(key)) + int64(value.Len())
+	if c.chargeOverhead {
+		size += lfu.EntryOverhead // 取lru/lfu中较大的估计
+	}
+	return size
+}
+
+// Peek 获取key对应的value 不会将数据从lru移到lfu
+func (c *Cache) Peek(key string) (value cachestrategy.Lengthable, ok bool) {
+	if v, ok := c.lru.Peek(key); ok {
+		return v, true
+	}
+	return c.lfu.Peek(key)
+}
+
+// Contains 看看key存不存在(不访问) ghost中的淘汰记录不算
+func (c *Cache) Contains(key string) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Keys 按淘汰顺序返回所有key
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, c.Len())
+	c.Range(func(key string, _ cachestrategy.Lengthable) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range 先遍历lru再遍历lfu 各自按淘汰顺序
+// 实际从哪一侧淘汰取决于part 所以这只是近似的淘汰顺序
+func (c *Cache) Range(fn func(key string, value cachestrategy.Lengthable) bool) {
+	stopped := false
+	c.lru.Range(func(key string, value cachestrategy.Lengthable) bool {
+		stopped = !fn(key, value)
+		return !stopped
+	})
+	if !stopped {
+		c.lfu.Range(fn)
+	}
+}
+
 // Get 从缓存获取对应key的value
 func (c *Cache) Get(key string) (value cachestrategy.Lengthable, ok bool) {
-	if v, ok := c.lru.Get(key); ok {
+	if v, expire, ok := c.lru.GetWithExpire(key); ok {
 		c.lru.Remove(key)
-		c.lfu.Add(key, v)
+		c.lfu.Add(key, v, expire)
 		return v, ok
 	}
 	if v, ok := c.lfu.Get(key); ok {
@@ -51,24 +174,37 @@ func (c *Cache) Get(key string) (value cachestrategy.Lengthable, ok bool) {
 }
 
 // Add 向缓存添加/更新一枚key-value
-func (c *Cache) Add(key string, value cachestrategy.Lengthable) {
+func (c *Cache) Add(key string, value cachestrategy.Lengthable, expire time.Time) {
+	// Contains不认已过期的缓存 先清理它们 避免同一个key同时出现在lru和lfu中
+	// Get会惰性删除已过期的缓存 并以过期为原因回调
+	old, ok := c.Peek(key)
+	if !ok {
+		c.lru.GetWithExpire(key)
+		c.lfu.GetWithExpire(key)
+	} else if c.callback != nil {
+		c.callback(key, old, cachestrategy.EvictReplaced)
+	}
 	// 如果lru有, 则移动到lfu
 	if c.lru.Contains(key) {
 		c.lru.Remove(key)
-		c.lfu.Add(key, value)
+		c.makeRoom(key, c.chargedSize(key, value), 1)
+		c.lfu.Add(key, value, expire)
 		return
 	}
-	// 如果lfu有, 则更新lfu
+	// 如果lfu有, 则更新lfu 新值可能更大 先删掉旧值再腾出空间
 	if c.lfu.Contains(key) {
-		c.lfu.Add(key, value)
+		c.lfu.Remove(key)
+		c.makeRoom(key, c.chargedSize(key, value), 1)
+		c.lfu.Add(key, value, expire)
 		return
 	}
+	kvSize := int64(len(key)) + int64(value.Len())
 	// 看看ghostLru和ghostLfu有没有
-	if c.ghostLru.Contains(key) {
-		kvSize := int64(len(key)) + int64(value.Len())
-		var delta int64 = kvSize
-		if c.ghostLru.CurrByte < c.ghostLfu.CurrByte {
-			delta = (c.ghostLfu.Len() / c.ghostLru.Len()) * kvSize
+	if c.ghostLru.contains(key) {
+		// 刚从lru淘汰又被访问 说明lru偏小 增大part
+		delta := kvSize
+		if c.ghostLru.bytes < c.ghostLfu.bytes {
+			delta = kvSize * c.ghostLfu.bytes / c.ghostLru.bytes
 		}
 		if c.part+delta < c.maxByte {
 			c.part += delta
@@ -76,20 +212,17 @@ func (c *Cache) Add(key string, value cachestrategy.Lengthable) {
 			c.part = c.maxByte
 		}
 
-		if c.lru.CurrByte+c.lfu.CurrByte >= c.maxByte {
-			c.replace(key)
-		}
-
-		c.ghostLru.Remove(key)
-		c.lfu.Add(key, value)
+		c.makeRoom(key, c.chargedSize(key, value), 1)
+		c.ghostLru.remove(key)
+		c.lfu.Add(key, value, expire)
 		return
 	}
 
-	if c.ghostLfu.Contains(key) {
-		kvSize := int64(len(key)) + int64(value.Len())
-		var delta int64 = kvSize
-		if c.ghostLru.CurrByte > c.ghostLfu.CurrByte {
-			delta = (c.ghostLru.Len() / c.ghostLfu.Len()) * kvSize
+	if c.ghostLfu.contains(key) {
+		// 刚从lfu淘汰又被访问 说明lfu偏小 减小part
+		delta := kvSize
+		if c.ghostLfu.bytes < c.ghostLru.bytes {
+			delta = kvSize * c.ghostLru.bytes / c.ghostLfu.bytes
 		}
 		if delta >= c.part {
 			c.part = 0
@@ -97,43 +230,56 @@ func (c *Cache) Add(key string, value cachestrategy.Lengthable) {
 			c.part -= delta
 		}
 
-		if c.lru.CurrByte+c.lfu.CurrByte >= c.maxByte {
-			c.replace(key)
-		}
-
-		c.ghostLfu.Remove(key)
-		c.lfu.Add(key, value)
+		c.makeRoom(key, c.chargedSize(key, value), 1)
+		c.ghostLfu.remove(key)
+		c.lfu.Add(key, value, expire)
 		return
 	}
 
 	// 四个缓存都没有,是全新数据
-	// 先看看是否容量满了
-	if c.lru.CurrByte+c.lfu.CurrByte >= c.maxByte {
-		c.replace(key)
-	}
-	// 然后看是否需要调整
-	if c.ghostLru.CurrByte > c.maxByte-c.part {
-		c.ghostLru.Evict()
-		if c.callback != nil {
-			c.callback(key, value)
+	// 先按ARC论文限制ghost的大小: lru+ghostLru不超过maxByte 四者之和不超过2*maxByte
+	if c.maxByte != 0 {
+		for c.lru.Len() > 0 && c.lru.CurrByte+c.ghostLru.bytes+kvSize > c.maxByte {
+			if c.ghostLru.len() > 0 {
+				c.ghostLru.evict()
+			} else {
+				// lru独占了全部容量 只访问一次的数据不值得记录 直接淘汰
+				c.lru.Evict()
+			}
 		}
-	}
-	if c.ghostLfu.CurrByte > c.part {
-		c.ghostLfu.Evict()
-		if c.callback != nil {
-			c.callback(key, value)
+		for c.ghostLfu.len() > 0 && c.Bytes()+c.ghostLru.bytes+c.ghostLfu.bytes+kvSize > 2*c.maxByte {
+			c.ghostLfu.evict()
 		}
 	}
+	// 再看看是否容量满了 淘汰的数据进入ghost
+	c.makeRoom(key, c.chargedSize(key, value), 1)
 	// 最后添加
-	c.lru.Add(key, value)
+	c.lru.Add(key, value, expire)
+}
+
+// Remove 删除特定key的数据 连同ghost中的淘汰记录一起删除
+func (c *Cache) Remove(key string) {
+	if value, ok := c.Peek(key); ok && c.callback != nil {
+		c.callback(key, value, cachestrategy.EvictRemoved)
+	}
+	c.lru.Remove(key)
+	c.lfu.Remove(key)
+	c.ghostLru.remove(key)
+	c.ghostLfu.remove(key)
+}
+
+// RemoveExpired 清理所有已过期的缓存 返回清理的个数
+// ghost中只是淘汰记录 不参与过期清理
+func (c *Cache) RemoveExpired() int {
+	return c.lru.RemoveExpired() + c.lfu.RemoveExpired()
 }
 
 func (c *Cache) replace(key string) {
-	if c.lru.Len() > 0 && (c.lru.CurrByte > c.part || (c.ghostLfu.Contains(key) && c.lru.CurrByte == c.part)) {
+	if c.lru.Len() > 0 && (c.lfu.Len() == 0 || c.lru.CurrByte > c.part || (c.ghostLfu.contains(key) && c.lru.CurrByte == c.part)) {
 		k, v := c.lru.Evict()
-		c.ghostLru.Add(k, v)
+		c.ghostLru.add(k, int64(len(k))+int64(v.Len()))
 	} else {
 		k, v := c.lfu.Evict()
-		c.ghostLfu.Add(k, v)
+		c.ghostLfu.add(k, int64(len(k))+int64(v.Len()))
 	}
 }
@@ -1,7 +1,12 @@
 package arc
 
 import (
+	"fmt"
+	"reflect"
+	cachestrategy "simple-groupcache/cache-strategy"
+	"strings"
 	"testing"
+	"time"
 )
 
 type String string
@@ -12,7 +17,7 @@ func (d String) Len() int {
 
 func TestGet(t *testing.T) {
 	cache := New(int64(10), nil)
-	cache.Add("key1", String("1234"))
+	cache.Add("key1", String("1234"), time.Time{})
 	if v, ok := cache.Get("key1"); !ok || string(v.(String)) != "1234" {
 		t.Fatalf("cache hit key1=1234 failed")
 	}
@@ -20,3 +25,100 @@ func TestGet(t *testing.T) {
 		t.Fatalf("cache miss key2 failed")
 	}
 }
+
+// hotKeys 写入并访问n个key 使它们进入lfu
+func hotKeys(cache *Cache, n int) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("h%d", i)
+		cache.Add(key, String("01234567"), time.Time{})
+		cache.Get(key)
+	}
+}
+
+func TestGhostKeysOnly(t *testing.T) {
+	cache := New(int64(100), nil)
+	hotKeys(cache, 4)
+	for i := 0; i < 100; i++ {
+		cache.Add(fmt.Sprintf("k%02d", i), String("0123456789"), time.Time{})
+	}
+	if cache.Bytes() > 100 || cache.ghostLru.len() == 0 {
+		t.Fatalf("expected evicted keys in ghostLru, bytes %d", cache.Bytes())
+	}
+	// ghost只保存key 实际内存只有key和结构开销
+	if cache.ghostLru.residentBytes() != cache.ghostLru.len()*(3+ghostEntryOverhead) {
+		t.Fatalf("ghost should not hold values, resident %d", cache.ghostLru.residentBytes())
+	}
+	if cache.lru.CurrByte+cache.ghostLru.bytes > 100 {
+		t.Fatalf("lru+ghostLru should not exceed maxByte")
+	}
+}
+
+func TestAdaptPart(t *testing.T) {
+	cache := New(int64(40), nil)
+	hotKeys(cache, 2)
+	for i := 0; i < 8; i++ {
+		cache.Add(fmt.Sprintf("k%d", i), String("01234567"), time.Time{})
+	}
+	// 刚从lru淘汰的key再次写入 说明lru偏小
+	key := cache.ghostLru.ll.Front().Value.(*ghostEntry).key
+	cache.Add(key, String("01234567"), time.Time{})
+	if cache.part == 0 || !cache.lfu.Contains(key) {
+		t.Fatalf("ghostLru hit should increase part, got %d", cache.part)
+	}
+	part := cache.part
+	// 继续写入新数据 直到lfu中有数据被淘汰
+	for i := 10; cache.ghostLfu.len() == 0; i++ {
+		cache.Add(fmt.Sprintf("k%d", i), String("01234567"), time.Time{})
+	}
+	// 刚从lfu淘汰的key再次写入 说明lfu偏小
+	key = cache.ghostLfu.ll.Front().Value.(*ghostEntry).key
+	cache.Add(key, String("01234567"), time.Time{})
+	if cache.part >= part {
+		t.Fatalf("ghostLfu hit should decrease part, got %d", cache.part)
+	}
+}
+
+func TestPeekRange(t *testing.T) {
+	cache := New(int64(0), nil)
+	cache.Add("k1", String("v1"), time.Time{})
+	cache.Add("k2", String("v2"), time.Time{})
+	cache.Get("k2")
+	if _, ok := cache.Peek("k1"); !ok || cache.lfu.Contains("k1") {
+		t.Fatalf("peek should not move k1 to lfu")
+	}
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != "k1" || keys[1] != "k2" {
+		t.Fatalf("expected lru keys before lfu keys, got %v", keys)
+	}
+}
+
+func TestEvictReason(t *testing.T) {
+	var reasons []cachestrategy.EvictReason
+	cache := New(int64(0), func(_ string, _ cachestrategy.Lengthable, reason cachestrategy.EvictReason) {
+		reasons = append(reasons, reason)
+	})
+	cache.Add("k1", String("v1"), time.Time{})
+	// 从lru移到lfu不应回调
+	cache.Get("k1")
+	cache.Add("k1", String("v2"), time.Time{})
+	cache.Remove("k1")
+	expect := []cachestrategy.EvictReason{cachestrategy.EvictReplaced, cachestrategy.EvictRemoved}
+	if !reflect.DeepEqual(reasons, expect) {
+		t.Fatalf("expected reasons %v, got %v", expect, reasons)
+	}
+}
+
+func TestUpdateLfuKey(t *testing.T) {
+	cache := New(int64(100), nil)
+	hotKeys(cache, 2) // 2*10字节 在lfu中
+	for i := 0; i < 6; i++ {
+		cache.Add(fmt.Sprintf("k%d", i), String("01234567"), time.Time{}) // 6*10字节 在lru中
+	}
+	// 更新后lfu自身没超过上限 但lru+lfu超过了
+	cache.Add("h0", String(strings.Repeat("0", 40)), time.Time{})
+	if cache.Bytes() > 100 {
+		t.Fatalf("expected at most 100 bytes after updating a lfu key, got %d", cache.Bytes())
+	}
+	if v, ok := cache.Peek("h0"); !ok || v.Len() != 40 {
+		t.Fatalf("updated key h0 should be kept")
+	}
+}
@@ -0,0 +1,78 @@
+package arc
+
+import "container/list"
+
+// ghostEntryOverhead 估计的每条淘汰记录的结构开销(字节)
+// list.Element(40) + ghostEntry(24) + map中key/指针及桶的均摊(32)
+const ghostEntryOverhead = 96
+
+// ghostEntry 是一条淘汰记录 只保存key和被淘汰时的大小 不保存value
+type ghostEntry struct {
+	key  string
+	size int64 // 被淘汰时key+value的字节数 用于调整part
+}
+
+// ghost 是ARC中记录最近被淘汰的key的LRU链表
+// 它只用来判断一个key是否刚被淘汰过 因此value在淘汰时就被释放
+type ghost struct {
+	maxBytes   int64 // 记录的size之和的上限 0表示不限制
+	maxEntries int64 // 记录条数的上限 0表示不限制
+	bytes      int64 // 记录的size之和
+	keyBytes   int64 // 记录的key的字节数之和
+	ll         *list.List
+	entries    map[string]*list.Element
+}
+
+func newGhost(maxBytes int64) *ghost {
+	return &ghost{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (g *ghost) len() int64 {
+	return int64(g.ll.Len())
+}
+
+func (g *ghost) contains(key string) bool {
+	_, ok := g.entries[key]
+	return ok
+}
+
+// residentBytes 返回估计的实际内存占用 只有key和结构开销
+func (g *ghost) residentBytes() int64 {
+	return g.keyBytes + g.len()*ghostEntryOverhead
+}
+
+// add 记录一个被淘汰的key 超出上限时丢弃最早的记录
+func (g *ghost) add(key string, size int64) {
+	g.remove(key)
+	g.entries[key] = g.ll.PushFront(&ghostEntry{key: key, size: size})
+	g.bytes += size
+	g.keyBytes += int64(len(key))
+	for g.len() > 0 && ((g.maxBytes != 0 && g.bytes > g.maxBytes) ||
+		(g.maxEntries != 0 && g.len() > g.maxEntries)) {
+		g.evict()
+	}
+}
+
+func (g *ghost) remove(key string) {
+	if elem, ok := g.entries[key]; ok {
+		g.removeElement(elem)
+	}
+}
+
+// evict 丢弃最早的记录
+func (g *ghost) evict() {
+	if elem := g.ll.Back(); elem != nil {
+		g.removeElement(elem)
+	}
+}
+
+func (g *ghost) removeElement(elem *list.Element) {
+	entry := g.ll.Remove(elem).(*ghostEntry)
+	delete(g.entries, entry.key)
+	g.bytes -= entry.size
+	g.keyBytes -= int64(len(entry.key))
+}
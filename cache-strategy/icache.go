@@ -1,15 +1,99 @@
 package cachestrategy
 
+import "time"
+
 // Lengthable 接口指明对象可以获取自身占有内存空间大小 以字节为单位
 type Lengthable interface {
 	Len() int
 }
 
-// OnEvicted 当key-value被淘汰时 执行的处理函数
-type OnEvicted func(key string, value Lengthable)
+// EvictReason 说明缓存被移出的原因
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota // 容量不足被淘汰
+	EvictExpired                     // 已过期被清理
+	EvictRemoved                     // 被Remove删除
+	EvictReplaced                    // 被新写入的值替换 回调中的value是旧值
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictRemoved:
+		return "removed"
+	case EvictReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// OnEvicted 当key-value被移出缓存时 执行的处理函数 reason说明移出的原因
+type OnEvicted func(key string, value Lengthable, reason EvictReason)
+
+// Clock 为缓存提供当前时间 用于判断缓存是否过期
+// 测试时可以注入一个假时钟 这样无需sleep即可测试过期行为
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock 使用系统时间的默认时钟
+var SystemClock Clock = systemClock{}
+
+// Expired 判断在now时刻 过期时间为expire的缓存是否已过期
+// expire为零值表示永不过期
+func Expired(expire time.Time, now time.Time) bool {
+	return !expire.IsZero() && !now.Before(expire)
+}
+
+// Limits 描述缓存的容量上限 超出任意一个上限都会触发淘汰
+type Limits struct {
+	MaxBytes   int64 // 最大字节数 0表示不限制
+	MaxEntries int64 // 最大条目数 0表示不限制
+	// ChargeOverhead 为true时 每条缓存除了key+value外
+	// 还按策略估计的结构开销(链表节点/map桶等)计入字节数
+	ChargeOverhead bool
+}
 
 type CacheStrategy interface {
 	Get(key string) (value Lengthable, ok bool)
-	Add(key string, value Lengthable)
+	// Add 添加/更新缓存 expire为零值表示永不过期
+	Add(key string, value Lengthable, expire time.Time)
+	// Remove 删除key对应的缓存 key不存在时什么也不做
+	Remove(key string)
+	// RemoveExpired 清理所有已过期的缓存 返回清理的个数
+	RemoveExpired() int
+	// SetClock 设置判断过期所使用的时钟
+	SetClock(clock Clock)
 	Len() int64
+	// Bytes 返回当前缓存占用的字节数(key+value)
+	Bytes() int64
+	// Peek 获取key对应的value 但不改变淘汰顺序 已过期的缓存视为不存在
+	Peek(key string) (value Lengthable, ok bool)
+	// Contains 判断key是否存在 不改变淘汰顺序 已过期的缓存视为不存在
+	Contains(key string) bool
+	// Keys 按淘汰顺序返回所有未过期的key 最先被淘汰的在前
+	Keys() []string
+	// Range 按淘汰顺序遍历所有未过期的缓存 fn返回false时停止 fn中不能修改缓存
+	Range(fn func(key string, value Lengthable) bool)
+	// ResidentBytes 返回估计的实际内存占用 即Bytes加上每条缓存的结构开销
+	ResidentBytes() int64
+	// SetLimits 设置容量上限 超出新上限的缓存会立即按淘汰顺序被淘汰
+	SetLimits(limits Limits)
+}
+
+// Ager 由支持频率衰减的缓存策略实现
+// 衰减使曾经热门但不再访问的数据的频率逐渐降低 淘汰顺序更能反映近期的热度
+type Ager interface {
+	// SetAging 设置每ops次访问或每经过period时间 将所有频率减半 0表示不按该条件衰减
+	SetAging(ops int64, period time.Duration)
 }
@@ -3,28 +3,51 @@ package lfu
 import (
 	"container/list"
 	cachestrategy "simple-groupcache/cache-strategy"
+	"sort"
+	"time"
 )
 
 // Node 定义双向链表节点所存储的对象
 // 其实key和freq可以不用存储在Node中，但是为了一些情况下查找方便，就存了
 type Node struct {
-	key   string
-	value cachestrategy.Lengthable
-	freq  int
+	key    string
+	value  cachestrategy.Lengthable
+	freq   int
+	expire time.Time // 过期时间 零值表示永不过期
 }
 
+// EntryOverhead 估计的每条缓存的结构开销(字节)
+// list.Element(40) + Node(64) + kvMap中key/指针及桶的均摊(32) + freqMap链表的均摊(8)
+const EntryOverhead = 144
+
 // Cache 是LFU算法实现的缓存
 type Cache struct {
-	MaxByte  int64                    // Cache 最大容量(Byte)
-	CurrByte int64                    // Cache 当前容量(Byte)
-	kvMap    map[string]*list.Element // key对应的双向链表节点
-	freqMap  map[int]*list.List       // 频率对应的双向链表,链头表示最近使用
-	minFreq  int                      // 最小频率
+	MaxByte        int64                    // Cache 最大容量(Byte)
+	CurrByte       int64                    // Cache 当前容量(Byte) 只计key+value
+	MaxEntries     int64                    // Cache 最大条目数 0表示不限制
+	chargeOverhead bool                     // 容量检查时是否计入EntryOverhead
+	kvMap          map[string]*list.Element // key对应的双向链表节点
+	freqMap        map[int]*list.List       // 频率对应的双向链表,链头表示最近使用
+	minFreq        int                      // 最小频率
+
+	// 频率衰减 默认不衰减
+	agingOps    int64         // 每agingOps次访问衰减一次 0表示不按次数衰减
+	agingPeriod time.Duration // 每经过agingPeriod衰减一次 0表示不按时间衰减
+	ops         int64         // 上次衰减后的访问次数
+	lastAging   time.Time     // 上次衰减的时间
 
 	callback cachestrategy.OnEvicted // 淘汰回调
+	clock    cachestrategy.Clock     // 判断过期的时钟
 }
 
 var _ cachestrategy.CacheStrategy = (*Cache)(nil)
+var _ cachestrategy.Ager = (*Cache)(nil)
+
+func init() {
+	cachestrategy.Register("lfu", func(maxBytes int64, callback cachestrategy.OnEvicted) cachestrategy.CacheStrategy {
+		return New(maxBytes, callback)
+	})
+}
 
 // New 创建指定最大容量的LFU缓存
 // 当maxBytes为0时，代表cache无内存限制，无限存放
@@ -34,6 +57,69 @@ func New(maxBytes int64, callback cachestrategy.OnEvicted) *Cache {
 		kvMap:    make(map[string]*list.Element),
 		freqMap:  make(map[int]*list.List),
 		callback: callback,
+		clock:    cachestrategy.SystemClock,
+	}
+}
+
+// SetClock 设置判断过期所使用的时钟
+func (c *Cache) SetClock(clock cachestrategy.Clock) {
+	c.clock = clock
+}
+
+// SetAging 设置频率衰减 每ops次访问(Get/Add)或每经过period时间 将所有频率减半
+func (c *Cache) SetAging(ops int64, period time.Duration) {
+	c.agingOps = ops
+	c.agingPeriod = period
+	c.ops = 0
+	c.lastAging = c.clock.Now()
+}
+
+// tick 记录一次访问 满足条件时进行衰减
+func (c *Cache) tick() {
+	if c.agingOps == 0 && c.agingPeriod == 0 {
+		return
+	}
+	c.ops++
+	if c.agingOps != 0 && c.ops >= c.agingOps {
+		c.age()
+		return
+	}
+	if c.agingPeriod != 0 {
+		if now := c.clock.Now(); now.Sub(c.lastAging) >= c.agingPeriod {
+			c.age()
+		}
+	}
+}
+
+// age 将所有节点的频率减半(至少为1) 并重建freqMap
+// 按原频率从低到高放入新链表 原频率高的排在前面 同频率内保持原有的新旧顺序
+func (c *Cache) age() {
+	c.ops = 0
+	c.lastAging = c.clock.Now()
+	freqs := make([]int, 0, len(c.freqMap))
+	for freq := range c.freqMap {
+		freqs = append(freqs, freq)
+	}
+	sort.Ints(freqs)
+	oldMap := c.freqMap
+	c.freqMap = make(map[int]*list.List)
+	c.minFreq = 0
+	for _, freq := range freqs {
+		newFreq := freq / 2
+		if newFreq < 1 {
+			newFreq = 1
+		}
+		if _, ok := c.freqMap[newFreq]; !ok {
+			c.freqMap[newFreq] = list.New()
+		}
+		if c.minFreq == 0 || newFreq < c.minFreq {
+			c.minFreq = newFreq
+		}
+		for elem := oldMap[freq].Back(); elem != nil; elem = elem.Prev() {
+			node := elem.Value.(*Node)
+			node.freq = newFreq
+			c.kvMap[node.key] = c.freqMap[newFreq].PushFront(node)
+		}
 	}
 }
 
@@ -42,51 +128,149 @@ func (c *Cache) Len() int64 {
 	return int64(len(c.kvMap))
 }
 
+// Bytes 返回当前缓存占用的字节数
+func (c *Cache) Bytes() int64 {
+	return c.CurrByte
+}
+
+// ResidentBytes 返回估计的实际内存占用
+func (c *Cache) ResidentBytes() int64 {
+	return c.CurrByte + c.Len()*EntryOverhead
+}
+
+// SetLimits 设置容量上限 并立即淘汰超出部分
+func (c *Cache) SetLimits(limits cachestrategy.Limits) {
+	c.MaxByte = limits.MaxBytes
+	c.MaxEntries = limits.MaxEntries
+	c.chargeOverhead = limits.ChargeOverhead
+	for c.overflow(0, 0) {
+		c.Evict()
+	}
+}
+
+// chargedBytes 返回容量检查时使用的字节数
+func (c *Cache) chargedBytes() int64 {
+	if c.chargeOverhead {
+		return c.ResidentBytes()
+	}
+	return c.CurrByte
+}
+
+// overflow 再放入extraBytes字节/extraEntries条后是否超出任意一个容量上限
+func (c *Cache) overflow(extraBytes, extraEntries int64) bool {
+	return (c.MaxByte != 0 && c.chargedBytes()+extraBytes > c.MaxByte) ||
+		(c.MaxEntries != 0 && c.Len()+extraEntries > c.MaxEntries)
+}
+
+// Contains 看看key存不存在(不访问)
 func (c *Cache) Contains(key string) bool {
-	if _, ok := c.kvMap[key]; ok {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Peek 获取key对应的value 但不增加访问频率
+func (c *Cache) Peek(key string) (value cachestrategy.Lengthable, ok bool) {
+	if elem, ok := c.kvMap[key]; ok {
+		node := elem.Value.(*Node)
+		if !cachestrategy.Expired(node.expire, c.clock.Now()) {
+			return node.value, true
+		}
+	}
+	return nil, false
+}
+
+// Keys 按淘汰顺序返回所有key
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, len(c.kvMap))
+	c.Range(func(key string, _ cachestrategy.Lengthable) bool {
+		keys = append(keys, key)
 		return true
+	})
+	return keys
+}
+
+// Range 按淘汰顺序遍历 频率从低到高 同频率内从链尾到链头 跳过已过期的缓存
+func (c *Cache) Range(fn func(key string, value cachestrategy.Lengthable) bool) {
+	freqs := make([]int, 0, len(c.freqMap))
+	for freq := range c.freqMap {
+		freqs = append(freqs, freq)
+	}
+	sort.Ints(freqs)
+	now := c.clock.Now()
+	for _, freq := range freqs {
+		for elem := c.freqMap[freq].Back(); elem != nil; elem = elem.Prev() {
+			node := elem.Value.(*Node)
+			if cachestrategy.Expired(node.expire, now) {
+				continue
+			}
+			if !fn(node.key, node.value) {
+				return
+			}
+		}
 	}
-	return false
 }
 
 // Get 从缓存获取对应key的value
 // ok 指明查询结果 false代表查无此key
 func (c *Cache) Get(key string) (value cachestrategy.Lengthable, ok bool) {
+	value, _, ok = c.GetWithExpire(key)
+	return
+}
+
+// GetWithExpire 与Get相同 但同时返回该缓存的过期时间
+// 已过期的缓存会被惰性删除 并视为未命中
+func (c *Cache) GetWithExpire(key string) (value cachestrategy.Lengthable, expire time.Time, ok bool) {
+	c.tick()
 	if elem, ok := c.kvMap[key]; ok {
-		c.updateFreq(elem)
 		node := elem.Value.(*Node)
-		return node.value, true
+		if cachestrategy.Expired(node.expire, c.clock.Now()) {
+			c.removeElement(elem, cachestrategy.EvictExpired)
+			return nil, time.Time{}, false
+		}
+		c.updateFreq(elem)
+		return node.value, node.expire, true
 	}
 	return
 }
 
 // Add 向缓存添加/更新一枚key-value
-func (c *Cache) Add(key string, value cachestrategy.Lengthable) {
+func (c *Cache) Add(key string, value cachestrategy.Lengthable, expire time.Time) {
 	kvSize := int64(len(key)) + int64(value.Len())
-	// cache 容量检查
-	for c.MaxByte != 0 && c.CurrByte+kvSize > c.MaxByte {
-		c.Evict()
+	charged := kvSize
+	if c.chargeOverhead {
+		charged += EntryOverhead
 	}
+	// 单个缓存超过最大容量 无论如何淘汰都放不下 直接丢弃
+	if c.MaxByte != 0 && charged > c.MaxByte {
+		if elem, ok := c.kvMap[key]; ok {
+			c.removeElement(elem, cachestrategy.EvictReplaced)
+		}
+		return
+	}
+	c.tick()
 
+	freq := 1
 	if elem, ok := c.kvMap[key]; ok {
-		node := elem.Value.(*Node)
-		c.CurrByte += int64(value.Len()) - int64(node.value.Len())
-		node.value = value
-		c.updateFreq(elem)
-	} else {
-		// 新增缓存key值
-		node := &Node{key: key, value: value, freq: 1}
-		// 如果freq为1的链表不存在，创建该链表
-		if _, ok := c.freqMap[1]; !ok {
-			c.freqMap[1] = list.New()
-		}
-		elem := c.freqMap[1].PushFront(node)
-		c.kvMap[key] = elem
-		// 更新minFreq
-		c.minFreq = 1
-		// 更新写入字节
-		c.CurrByte += kvSize
+		// 更新缓存 先摘下旧节点并保留频率 避免腾空间时把自己淘汰掉
+		freq = elem.Value.(*Node).freq + 1
+		c.removeElement(elem, cachestrategy.EvictReplaced)
+	}
+	// cache 容量检查
+	for c.overflow(charged, 1) {
+		c.Evict()
+	}
+	node := &Node{key: key, value: value, freq: freq, expire: expire}
+	// 如果freq对应的链表不存在，创建该链表
+	if _, ok := c.freqMap[freq]; !ok {
+		c.freqMap[freq] = list.New()
+	}
+	// 更新minFreq
+	if len(c.kvMap) == 0 || freq < c.minFreq {
+		c.minFreq = freq
 	}
+	c.kvMap[key] = c.freqMap[freq].PushFront(node)
+	// 更新写入字节
+	c.CurrByte += kvSize
 }
 
 // Evict 淘汰一枚最低频率的缓存,如果次数相同,则淘汰最早的数据
@@ -94,31 +278,39 @@ func (c *Cache) Evict() (string, cachestrategy.Lengthable) {
 	if len(c.kvMap) == 0 {
 		return "", nil
 	}
-	// 获取最低频率的链表
-	lowFreqList := c.freqMap[c.minFreq]
 	// 获取最低频率链表的最后一个节点
-	node := lowFreqList.Back().Value.(*Node)
-	// 删除最低频率链表的最后一个节点
-	lowFreqList.Remove(lowFreqList.Back())
-	// 删除kvMap中对应的key
-	delete(c.kvMap, node.key)
-	// 更新写入字节
-	c.CurrByte -= int64(len(node.key)) + int64(node.value.Len())
-	// 如果最低频率链表为空，删除该链表
-	if lowFreqList.Len() == 0 {
-		delete(c.freqMap, c.minFreq)
-	}
-	// 执行淘汰回调
-	if c.callback != nil {
-		c.callback(node.key, node.value)
-	}
+	elem := c.freqMap[c.minFreq].Back()
+	node := elem.Value.(*Node)
+	c.removeElement(elem, cachestrategy.EvictCapacity)
 	return node.key, node.value
 }
 
+// RemoveExpired 清理所有已过期的缓存 返回清理的个数
+func (c *Cache) RemoveExpired() int {
+	now := c.clock.Now()
+	count := 0
+	for _, elem := range c.kvMap {
+		if cachestrategy.Expired(elem.Value.(*Node).expire, now) {
+			c.removeElement(elem, cachestrategy.EvictExpired)
+			count++
+		}
+	}
+	return count
+}
+
 func (c *Cache) updateFreq(elem *list.Element) {
 	node := elem.Value.(*Node)
 	// 将节点从原来的freq对应的链表中删除
-	c.freqMap[node.freq].Remove(elem)
+	oldList := c.freqMap[node.freq]
+	oldList.Remove(elem)
+	// 如果原来的freq对应的链表为空，删除该链表
+	if oldList.Len() == 0 {
+		delete(c.freqMap, node.freq)
+		// 更新minFreq
+		if c.minFreq == node.freq {
+			c.minFreq++
+		}
+	}
 	// 更新节点的freq
 	node.freq++
 	// 如果新的freq对应的链表不存在，创建该链表
@@ -126,29 +318,27 @@ func (c *Cache) updateFreq(elem *list.Element) {
 		c.freqMap[node.freq] = list.New()
 	}
 	// 将节点插入到新的freq对应的链表中
-	c.freqMap[node.freq].PushFront(elem)
-	// 如果原来的freq对应的链表为空，删除该链表
-	if c.freqMap[node.freq].Len() == 0 {
-		delete(c.freqMap, node.freq)
-	}
-	// 更新minFreq
-	if c.minFreq == node.freq-1 {
-		c.minFreq++
-	}
+	c.kvMap[node.key] = c.freqMap[node.freq].PushFront(node)
 }
 
 func (c *Cache) Remove(key string) {
 	if elem, ok := c.kvMap[key]; ok {
-		node := elem.Value.(*Node)
-		c.freqMap[node.freq].Remove(elem)
-		delete(c.kvMap, node.key)
-		c.CurrByte -= int64(len(node.key)) + int64(node.value.Len())
-		if c.freqMap[node.freq].Len() == 0 {
-			delete(c.freqMap, node.freq)
-			if len(c.freqMap) == 0 {
-				c.minFreq = 0
-				return
-			}
+		c.removeElement(elem, cachestrategy.EvictRemoved)
+	}
+}
+
+// removeElement 移除链表节点及其映射 并更新占用内存情况
+// reason 是移出的原因 会传给回调
+func (c *Cache) removeElement(elem *list.Element, reason cachestrategy.EvictReason) {
+	node := elem.Value.(*Node)
+	c.freqMap[node.freq].Remove(elem)
+	delete(c.kvMap, node.key)
+	c.CurrByte -= int64(len(node.key)) + int64(node.value.Len())
+	if c.freqMap[node.freq].Len() == 0 {
+		delete(c.freqMap, node.freq)
+		if len(c.freqMap) == 0 {
+			c.minFreq = 0
+		} else if c.minFreq == node.freq {
 			// 更新minFreq
 			newFreq := node.freq + 1
 			for {
@@ -160,4 +350,8 @@ func (c *Cache) Remove(key string) {
 			}
 		}
 	}
+	// 执行淘汰回调
+	if c.callback != nil {
+		c.callback(node.key, node.value, reason)
+	}
 }
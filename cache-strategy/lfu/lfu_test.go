@@ -4,6 +4,7 @@ import (
 	"reflect"
 	cachestrategy "simple-groupcache/cache-strategy"
 	"testing"
+	"time"
 )
 
 type String string
@@ -14,7 +15,7 @@ func (d String) Len() int {
 
 func TestGet(t *testing.T) {
 	cache := New(int64(0), nil)
-	cache.Add("key1", String("1234"))
+	cache.Add("key1", String("1234"), time.Time{})
 	if v, ok := cache.Get("key1"); !ok || string(v.(String)) != "1234" {
 		t.Fatalf("cache hit key1=1234 failed")
 	}
@@ -28,13 +29,13 @@ func TestEvict(t *testing.T) {
 	v1, v2, v3, v4 := "v1", "v2", "v3", "v4"
 	cap := len(k1 + k2 + v1 + v2 + k3 + v3)
 	lfu := New(int64(cap), nil)
-	lfu.Add(k1, String(v1))
-	lfu.Add(k1, String(v1))
-	lfu.Add(k1, String(v1))
-	lfu.Add(k2, String(v2))
-	lfu.Add(k3, String(v3))
-	lfu.Add(k3, String(v3))
-	lfu.Add(k4, String(v4))
+	lfu.Add(k1, String(v1), time.Time{})
+	lfu.Add(k1, String(v1), time.Time{})
+	lfu.Add(k1, String(v1), time.Time{})
+	lfu.Add(k2, String(v2), time.Time{})
+	lfu.Add(k3, String(v3), time.Time{})
+	lfu.Add(k3, String(v3), time.Time{})
+	lfu.Add(k4, String(v4), time.Time{})
 
 	if _, ok := lfu.Get("k2"); ok || lfu.Len() != 3 {
 		t.Fatalf("Remove key2 failed")
@@ -43,14 +44,14 @@ func TestEvict(t *testing.T) {
 
 func TestOnEvicted(t *testing.T) {
 	keys := make([]string, 0)
-	callback := func(key string, value cachestrategy.Lengthable) {
+	callback := func(key string, value cachestrategy.Lengthable, _ cachestrategy.EvictReason) {
 		keys = append(keys, key)
 	}
 	lfu := New(int64(10), callback)
-	lfu.Add("key1", String("123456"))
-	lfu.Add("k2", String("k2"))
-	lfu.Add("k3", String("k3"))
-	lfu.Add("k4", String("k4"))
+	lfu.Add("key1", String("123456"), time.Time{})
+	lfu.Add("k2", String("k2"), time.Time{})
+	lfu.Add("k3", String("k3"), time.Time{})
+	lfu.Add("k4", String("k4"), time.Time{})
 
 	expect := []string{"key1", "k2"}
 
@@ -61,10 +62,111 @@ func TestOnEvicted(t *testing.T) {
 
 func TestAdd(t *testing.T) {
 	lfu := New(int64(0), nil)
-	lfu.Add("key", String("1"))
-	lfu.Add("key", String("111"))
+	lfu.Add("key", String("1"), time.Time{})
+	lfu.Add("key", String("111"), time.Time{})
 
 	if lfu.CurrByte != int64(len("key")+len("111")) {
 		t.Fatal("expected 6 but got", lfu.CurrByte)
 	}
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestExpire(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cache := New(int64(0), nil)
+	cache.SetClock(clock)
+	cache.Add("k1", String("v1"), clock.now.Add(time.Second))
+	cache.Add("k2", String("v2"), clock.now.Add(time.Minute))
+	cache.Add("k3", String("v3"), time.Time{})
+
+	if _, ok := cache.Get("k1"); !ok {
+		t.Fatalf("k1 should not expire yet")
+	}
+	clock.now = clock.now.Add(time.Second)
+	if _, ok := cache.Get("k1"); ok || cache.Len() != 2 {
+		t.Fatalf("k1 should be expired and removed")
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if n := cache.RemoveExpired(); n != 1 || cache.Len() != 1 {
+		t.Fatalf("expected 1 expired entry removed, got %d", n)
+	}
+	if _, ok := cache.Get("k3"); !ok || cache.CurrByte != int64(len("k3v3")) {
+		t.Fatalf("k3 should never expire")
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.SetLimits(cachestrategy.Limits{MaxEntries: 2})
+	lfu.Add("k1", String("v1"), time.Time{})
+	lfu.Add("k1", String("v1"), time.Time{})
+	lfu.Add("k2", String("v2"), time.Time{})
+	lfu.Add("k3", String("v3"), time.Time{})
+
+	if _, ok := lfu.Get("k2"); ok || lfu.Len() != 2 || !lfu.Contains("k1") {
+		t.Fatalf("max entries should evict the least frequent k2")
+	}
+	// 更新已有缓存不应把自己淘汰掉
+	lfu.Add("k3", String("v3"), time.Time{})
+	if !lfu.Contains("k3") || lfu.Len() != 2 {
+		t.Fatalf("updating k3 should keep it")
+	}
+}
+
+func TestAging(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.SetLimits(cachestrategy.Limits{MaxEntries: 2})
+	lfu.SetAging(10, 0)
+	lfu.Add("old", String("v"), time.Time{})
+	for i := 0; i < 7; i++ {
+		lfu.Get("old")
+	}
+	// old不再被访问 new持续被访问 衰减后old的频率会低于new
+	lfu.Add("new", String("v"), time.Time{})
+	for i := 0; i < 30; i++ {
+		lfu.Get("new")
+	}
+	lfu.Add("x", String("v"), time.Time{})
+	if lfu.Contains("old") || !lfu.Contains("new") {
+		t.Fatalf("aged old should be evicted ahead of new")
+	}
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	lfu = New(int64(0), nil)
+	lfu.SetClock(clock)
+	lfu.SetAging(0, time.Minute)
+	lfu.Add("k1", String("v1"), time.Time{})
+	for i := 0; i < 7; i++ {
+		lfu.Get("k1")
+	}
+	for i := 0; i < 3; i++ {
+		clock.now = clock.now.Add(time.Minute)
+		lfu.Get("k2")
+	}
+	if freq := lfu.kvMap["k1"].Value.(*Node).freq; freq != 1 {
+		t.Fatalf("expected freq halved 3 times to 1, got %d", freq)
+	}
+}
+
+func TestPeekRange(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("k1", String("v1"), time.Time{})
+	lfu.Add("k2", String("v2"), time.Time{})
+	lfu.Add("k3", String("v3"), time.Time{})
+	lfu.Get("k1")
+	lfu.Get("k1")
+	lfu.Get("k2")
+	if _, ok := lfu.Peek("k3"); !ok {
+		t.Fatalf("peek k3 failed")
+	}
+	if keys := lfu.Keys(); !reflect.DeepEqual(keys, []string{"k3", "k2", "k1"}) {
+		t.Fatalf("expected keys in eviction order, got %v", keys)
+	}
+}
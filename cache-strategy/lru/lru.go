@@ -7,29 +7,44 @@ package lru
 import (
 	"container/list"
 	cachestrategy "simple-groupcache/cache-strategy"
+	"time"
 )
 
 // Node 定义双向链表节点所存储的对象
 // 在链表中仍保存每个值对应的 key 的好处在于，淘汰队首节点时，需要用 key 从字典中删除对应的映射
 type Node struct {
-	key   string
-	value cachestrategy.Lengthable
+	key    string
+	value  cachestrategy.Lengthable
+	expire time.Time // 过期时间 零值表示永不过期
 }
 
+// EntryOverhead 估计的每条缓存的结构开销(字节)
+// list.Element(40) + Node(56) + map中key/指针及桶的均摊(32)
+const EntryOverhead = 128
+
 // Cache 是LRU算法实现的缓存
 // 参考Leetcode使用哈希表+双向链表实现LRU
 type Cache struct {
 	MaxByte          int64 // Cache 最大容量(Byte)
-	CurrByte         int64 // Cache 当前容量(Byte)
+	CurrByte         int64 // Cache 当前容量(Byte) 只计key+value
+	MaxEntries       int64 // Cache 最大条目数 0表示不限制
+	chargeOverhead   bool  // 容量检查时是否计入EntryOverhead
 	hashmap          map[string]*list.Element
 	doublyLinkedList *list.List // 链头表示最近使用
 
 	callback cachestrategy.OnEvicted // 淘汰回调
+	clock    cachestrategy.Clock     // 判断过期的时钟
 }
 
 // 确保Cache实现了CacheStrategy接口
 var _ cachestrategy.CacheStrategy = (*Cache)(nil)
 
+func init() {
+	cachestrategy.Register("lru", func(maxBytes int64, callback cachestrategy.OnEvicted) cachestrategy.CacheStrategy {
+		return New(maxBytes, callback)
+	})
+}
+
 // New 创建指定最大容量的LRU缓存
 // 当maxBytes为0时，代表cache无内存限制，无限存放
 func New(maxBytes int64, callback cachestrategy.OnEvicted) *Cache {
@@ -38,39 +53,135 @@ func New(maxBytes int64, callback cachestrategy.OnEvicted) *Cache {
 		hashmap:          make(map[string]*list.Element),
 		doublyLinkedList: list.New(),
 		callback:         callback,
+		clock:            cachestrategy.SystemClock,
 	}
 }
 
+// SetClock 设置判断过期所使用的时钟
+func (c *Cache) SetClock(clock cachestrategy.Clock) {
+	c.clock = clock
+}
+
 // Len 返回当前缓存元素个数
 func (c *Cache) Len() int64 {
 	return int64(c.doublyLinkedList.Len())
 }
 
+// Bytes 返回当前缓存占用的字节数
+func (c *Cache) Bytes() int64 {
+	return c.CurrByte
+}
+
+// ResidentBytes 返回估计的实际内存占用
+func (c *Cache) ResidentBytes() int64 {
+	return c.CurrByte + c.Len()*EntryOverhead
+}
+
+// SetLimits 设置容量上限 并立即淘汰超出部分
+func (c *Cache) SetLimits(limits cachestrategy.Limits) {
+	c.MaxByte = limits.MaxBytes
+	c.MaxEntries = limits.MaxEntries
+	c.chargeOverhead = limits.ChargeOverhead
+	c.evictOverflow()
+}
+
+// chargedBytes 返回容量检查时使用的字节数
+func (c *Cache) chargedBytes() int64 {
+	if c.chargeOverhead {
+		return c.ResidentBytes()
+	}
+	return c.CurrByte
+}
+
+// overflow 再放入extraBytes字节/extraEntries条后是否超出任意一个容量上限
+func (c *Cache) overflow(extraBytes, extraEntries int64) bool {
+	return (c.MaxByte != 0 && c.chargedBytes()+extraBytes > c.MaxByte) ||
+		(c.MaxEntries != 0 && c.Len()+extraEntries > c.MaxEntries)
+}
+
+// evictOverflow 不断淘汰直到满足容量上限
+func (c *Cache) evictOverflow() {
+	for c.overflow(0, 0) {
+		c.Evict()
+	}
+}
+
 // Contains,看看key存不存在(不访问)
 func (c *Cache) Contains(key string) bool {
-	if _, ok := c.hashmap[key]; ok {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Peek 获取key对应的value 但不移动链表节点
+func (c *Cache) Peek(key string) (value cachestrategy.Lengthable, ok bool) {
+	if elem, ok := c.hashmap[key]; ok {
+		entry := elem.Value.(*Node)
+		if !cachestrategy.Expired(entry.expire, c.clock.Now()) {
+			return entry.value, true
+		}
+	}
+	return nil, false
+}
+
+// Keys 按淘汰顺序返回所有key 即从链尾到链头
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, c.doublyLinkedList.Len())
+	c.Range(func(key string, _ cachestrategy.Lengthable) bool {
+		keys = append(keys, key)
 		return true
+	})
+	return keys
+}
+
+// Range 从链尾到链头遍历 跳过已过期的缓存
+func (c *Cache) Range(fn func(key string, value cachestrategy.Lengthable) bool) {
+	now := c.clock.Now()
+	for elem := c.doublyLinkedList.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*Node)
+		if cachestrategy.Expired(entry.expire, now) {
+			continue
+		}
+		if !fn(entry.key, entry.value) {
+			return
+		}
 	}
-	return false
 }
 
 // Get 从缓存获取对应key的value
 // ok 指明查询结果 false代表查无此key
 func (c *Cache) Get(key string) (value cachestrategy.Lengthable, ok bool) {
+	value, _, ok = c.GetWithExpire(key)
+	return
+}
+
+// GetWithExpire 与Get相同 但同时返回该缓存的过期时间
+// 已过期的缓存会被惰性删除 并视为未命中
+func (c *Cache) GetWithExpire(key string) (value cachestrategy.Lengthable, expire time.Time, ok bool) {
 	if elem, ok := c.hashmap[key]; ok {
-		c.doublyLinkedList.MoveToFront(elem)
 		entry := elem.Value.(*Node)
-		return entry.value, true
+		if cachestrategy.Expired(entry.expire, c.clock.Now()) {
+			c.removeElement(elem, cachestrategy.EvictExpired)
+			return nil, time.Time{}, false
+		}
+		c.doublyLinkedList.MoveToFront(elem)
+		return entry.value, entry.expire, true
 	}
 	return
 }
 
 // Add 向缓存添加/更新一枚key-value
-func (c *Cache) Add(key string, value cachestrategy.Lengthable) {
+func (c *Cache) Add(key string, value cachestrategy.Lengthable, expire time.Time) {
 	kvSize := int64(len(key)) + int64(value.Len())
-	// cache 容量检查
-	for c.MaxByte != 0 && c.CurrByte+kvSize > c.MaxByte {
-		c.Evict()
+	charged := kvSize
+	if c.chargeOverhead {
+		charged += EntryOverhead
+	}
+	// 单个缓存超过最大容量 无论如何淘汰都放不下 直接丢弃
+	if c.MaxByte != 0 && charged > c.MaxByte {
+		if elem, ok := c.hashmap[key]; ok {
+			c.removeElement(elem, cachestrategy.EvictReplaced)
+		}
+		return
 	}
 	if elem, ok := c.hashmap[key]; ok {
 		// 更新缓存key值
@@ -78,13 +189,20 @@ func (c *Cache) Add(key string, value cachestrategy.Lengthable) {
 		oldEntry := elem.Value.(*Node)
 		// 先更新写入字节 再更新
 		c.CurrByte += int64(value.Len()) - int64(oldEntry.value.Len())
+		oldValue := oldEntry.value
 		oldEntry.value = value
+		oldEntry.expire = expire
+		if c.callback != nil {
+			c.callback(key, oldValue, cachestrategy.EvictReplaced)
+		}
 	} else {
 		// 新增缓存key
-		elem := c.doublyLinkedList.PushFront(&Node{key: key, value: value})
+		elem := c.doublyLinkedList.PushFront(&Node{key: key, value: value, expire: expire})
 		c.hashmap[key] = elem
 		c.CurrByte += kvSize
 	}
+	// cache 容量检查 新写入的在链头 不会被自己淘汰
+	c.evictOverflow()
 }
 
 // Evict 淘汰一枚最近最不常用缓存
@@ -92,25 +210,43 @@ func (c *Cache) Evict() (string, cachestrategy.Lengthable) {
 	tailElem := c.doublyLinkedList.Back()
 	if tailElem != nil {
 		entry := tailElem.Value.(*Node)
-		k, v := entry.key, entry.value
-		delete(c.hashmap, k)                         // 移除映射
-		c.doublyLinkedList.Remove(tailElem)          // 移除缓存
-		c.CurrByte -= int64(len(k)) + int64(v.Len()) // 更新占用内存情况
-		// 移除后的善后处理
-		if c.callback != nil {
-			c.callback(k, v)
-		}
-		return k, v
+		c.removeElement(tailElem, cachestrategy.EvictCapacity)
+		return entry.key, entry.value
 	}
 	return "", nil
 }
 
+// RemoveExpired 清理所有已过期的缓存 返回清理的个数
+func (c *Cache) RemoveExpired() int {
+	now := c.clock.Now()
+	count := 0
+	for elem := c.doublyLinkedList.Back(); elem != nil; {
+		prev := elem.Prev()
+		if cachestrategy.Expired(elem.Value.(*Node).expire, now) {
+			c.removeElement(elem, cachestrategy.EvictExpired)
+			count++
+		}
+		elem = prev
+	}
+	return count
+}
+
 // Remove 删除特定key的数据
 func (c *Cache) Remove(key string) {
 	if elem, ok := c.hashmap[key]; ok {
-		entry := elem.Value.(*Node)
-		delete(c.hashmap, key)
-		c.doublyLinkedList.Remove(elem)
-		c.CurrByte -= int64(len(key)) + int64(entry.value.Len())
+		c.removeElement(elem, cachestrategy.EvictRemoved)
+	}
+}
+
+// removeElement 移除链表节点及其映射 并更新占用内存情况
+// reason 是移出的原因 会传给回调
+func (c *Cache) removeElement(elem *list.Element, reason cachestrategy.EvictReason) {
+	entry := elem.Value.(*Node)
+	delete(c.hashmap, entry.key)
+	c.doublyLinkedList.Remove(elem)
+	c.CurrByte -= int64(len(entry.key)) + int64(entry.value.Len())
+	// 移除后的善后处理
+	if c.callback != nil {
+		c.callback(entry.key, entry.value, reason)
 	}
 }
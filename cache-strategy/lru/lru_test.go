@@ -4,6 +4,7 @@ import (
 	"reflect"
 	cachestrategy "simple-groupcache/cache-strategy"
 	"testing"
+	"time"
 )
 
 type String string
@@ -14,7 +15,7 @@ func (d String) Len() int {
 
 func TestGet(t *testing.T) {
 	cache := New(int64(0), nil)
-	cache.Add("key1", String("1234"))
+	cache.Add("key1", String("1234"), time.Time{})
 	if v, ok := cache.Get("key1"); !ok || string(v.(String)) != "1234" {
 		t.Fatalf("cache hit key1=1234 failed")
 	}
@@ -28,9 +29,9 @@ func TestEvict(t *testing.T) {
 	v1, v2, v3 := "v1", "v2", "v3"
 	cap := len(k1 + k2 + v1 + v2)
 	lru := New(int64(cap), nil)
-	lru.Add(k1, String(v1))
-	lru.Add(k2, String(v2))
-	lru.Add(k3, String(v3))
+	lru.Add(k1, String(v1), time.Time{})
+	lru.Add(k2, String(v2), time.Time{})
+	lru.Add(k3, String(v3), time.Time{})
 
 	if _, ok := lru.Get("key1"); ok || lru.Len() != 2 {
 		t.Fatalf("Removeoldest key1 failed")
@@ -39,14 +40,14 @@ func TestEvict(t *testing.T) {
 
 func TestOnEvicted(t *testing.T) {
 	keys := make([]string, 0)
-	callback := func(key string, value cachestrategy.Lengthable) {
+	callback := func(key string, value cachestrategy.Lengthable, _ cachestrategy.EvictReason) {
 		keys = append(keys, key)
 	}
 	lru := New(int64(10), callback)
-	lru.Add("key1", String("123456"))
-	lru.Add("k2", String("k2"))
-	lru.Add("k3", String("k3"))
-	lru.Add("k4", String("k4"))
+	lru.Add("key1", String("123456"), time.Time{})
+	lru.Add("k2", String("k2"), time.Time{})
+	lru.Add("k3", String("k3"), time.Time{})
+	lru.Add("k4", String("k4"), time.Time{})
 
 	expect := []string{"key1", "k2"}
 
@@ -57,10 +58,122 @@ func TestOnEvicted(t *testing.T) {
 
 func TestAdd(t *testing.T) {
 	lru := New(int64(0), nil)
-	lru.Add("key", String("1"))
-	lru.Add("key", String("111"))
+	lru.Add("key", String("1"), time.Time{})
+	lru.Add("key", String("111"), time.Time{})
 
 	if lru.CurrByte != int64(len("key")+len("111")) {
 		t.Fatal("expected 6 but got", lru.CurrByte)
 	}
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestExpire(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cache := New(int64(0), nil)
+	cache.SetClock(clock)
+	cache.Add("k1", String("v1"), clock.now.Add(time.Second))
+	cache.Add("k2", String("v2"), clock.now.Add(time.Minute))
+	cache.Add("k3", String("v3"), time.Time{})
+
+	if _, ok := cache.Get("k1"); !ok {
+		t.Fatalf("k1 should not expire yet")
+	}
+	clock.now = clock.now.Add(time.Second)
+	if _, ok := cache.Get("k1"); ok || cache.Len() != 2 {
+		t.Fatalf("k1 should be expired and removed")
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if n := cache.RemoveExpired(); n != 1 || cache.Len() != 1 {
+		t.Fatalf("expected 1 expired entry removed, got %d", n)
+	}
+	if _, ok := cache.Get("k3"); !ok || cache.CurrByte != int64(len("k3v3")) {
+		t.Fatalf("k3 should never expire")
+	}
+}
+
+func TestAddOversize(t *testing.T) {
+	lru := New(int64(4), nil)
+	lru.Add("k1", String("v1"), time.Time{})
+	lru.Add("k1", String("too large"), time.Time{})
+
+	if _, ok := lru.Get("k1"); ok || lru.CurrByte != 0 {
+		t.Fatalf("entry larger than MaxByte should not be cached")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.SetLimits(cachestrategy.Limits{MaxEntries: 2})
+	lru.Add("k1", String("v1"), time.Time{})
+	lru.Add("k2", String("v2"), time.Time{})
+	lru.Add("k3", String("v3"), time.Time{})
+	if _, ok := lru.Get("k1"); ok || lru.Len() != 2 {
+		t.Fatalf("max entries should evict k1")
+	}
+
+	// 计入结构开销后 每条缓存占用4+EntryOverhead字节
+	lru.SetLimits(cachestrategy.Limits{MaxBytes: 2*(4+EntryOverhead) - 1, ChargeOverhead: true})
+	if _, ok := lru.Get("k2"); ok || lru.Len() != 1 {
+		t.Fatalf("shrinking limits should evict k2 immediately")
+	}
+	if lru.ResidentBytes() != 4+EntryOverhead || lru.Bytes() != 4 {
+		t.Fatalf("unexpected resident bytes %d", lru.ResidentBytes())
+	}
+}
+
+func TestPeekRange(t *testing.T) {
+	lru := New(int64(12), nil)
+	lru.Add("k1", String("v1"), time.Time{})
+	lru.Add("k2", String("v2"), time.Time{})
+	lru.Add("k3", String("v3"), time.Time{})
+	if v, ok := lru.Peek("k1"); !ok || string(v.(String)) != "v1" {
+		t.Fatalf("peek k1 failed")
+	}
+	if keys := lru.Keys(); !reflect.DeepEqual(keys, []string{"k1", "k2", "k3"}) {
+		t.Fatalf("peek should not change eviction order, got %v", keys)
+	}
+	lru.Add("k4", String("v4"), time.Time{})
+	if lru.Contains("k1") || !lru.Contains("k2") {
+		t.Fatalf("k1 should still be evicted first")
+	}
+	var keys []string
+	lru.Range(func(key string, _ cachestrategy.Lengthable) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if !reflect.DeepEqual(keys, []string{"k2", "k3"}) {
+		t.Fatalf("range should stop when fn returns false, got %v", keys)
+	}
+}
+
+func TestEvictReason(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	reasons := make(map[string]cachestrategy.EvictReason)
+	lru := New(int64(8), func(key string, _ cachestrategy.Lengthable, reason cachestrategy.EvictReason) {
+		reasons[key] = reason
+	})
+	lru.SetClock(clock)
+	lru.Add("k1", String("v1"), time.Time{})
+	lru.Add("k1", String("v2"), time.Time{})
+	lru.Add("k2", String("v2"), clock.now.Add(time.Second))
+	lru.Add("k3", String("v3"), time.Time{})
+	lru.Remove("k3")
+	clock.now = clock.now.Add(time.Second)
+	lru.RemoveExpired()
+
+	expect := map[string]cachestrategy.EvictReason{
+		"k1": cachestrategy.EvictCapacity, // 先被替换 后被k3挤出
+		"k2": cachestrategy.EvictExpired,
+		"k3": cachestrategy.EvictRemoved,
+	}
+	if !reflect.DeepEqual(reasons, expect) {
+		t.Fatalf("expected reasons %v, got %v", expect, reasons)
+	}
+}
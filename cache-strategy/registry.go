@@ -0,0 +1,51 @@
+package cachestrategy
+
+// registry 模块负责管理可用的缓存策略
+// 各个策略包在init时将自己注册进来 使用者也可以注册自己实现的策略
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory 创建一个最大容量为maxBytes 淘汰时执行callback的缓存策略实例
+type Factory func(maxBytes int64, callback OnEvicted) CacheStrategy
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register 以name注册一个缓存策略 name重复注册会panic
+func Register(name string, factory Factory) {
+	if factory == nil {
+		panic("cache strategy factory must be existed!")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("cache strategy %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Lookup 查找以name注册的缓存策略
+func Lookup(name string) (Factory, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	factory, ok := factories[name]
+	return factory, ok
+}
+
+// Names 返回所有已注册的缓存策略名 按字典序排列
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,149 @@
+package tinylfu
+
+// sketch 模块实现了TinyLFU的频率估计器
+// count-min sketch 以很小的内存代价估计每个key的访问频率
+// doorkeeper 是挡在sketch前面的布隆过滤器 只访问过一次的key不会进入sketch
+// 这样大量只出现一次的key不会污染sketch中的计数
+
+import "hash/fnv"
+
+const (
+	sketchDepth = 4  // count-min sketch的行数
+	maxCounter  = 15 // 计数器上限 与4bit计数器一致
+)
+
+// countMinSketch 是计数器有上限的count-min sketch
+type countMinSketch struct {
+	rows [sketchDepth][]uint8
+	mask uint64
+}
+
+func newCountMinSketch(width int) *countMinSketch {
+	s := &countMinSketch{mask: uint64(width - 1)}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) increment(h uint64) {
+	for i := range s.rows {
+		idx := indexOf(h, i) & s.mask
+		if s.rows[i][idx] < maxCounter {
+			s.rows[i][idx]++
+		}
+	}
+}
+
+// estimate 返回所有行中最小的计数 即频率的估计值
+func (s *countMinSketch) estimate(h uint64) uint8 {
+	min := uint8(maxCounter)
+	for i := range s.rows {
+		if v := s.rows[i][indexOf(h, i)&s.mask]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// halve 将所有计数减半 让频率随时间衰减
+func (s *countMinSketch) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+}
+
+// doorkeeper 是一个简单的布隆过滤器
+type doorkeeper struct {
+	bits []uint64
+	mask uint64
+}
+
+func newDoorkeeper(bits int) *doorkeeper {
+	return &doorkeeper{bits: make([]uint64, (bits+63)/64), mask: uint64(bits - 1)}
+}
+
+// allow 将h加入过滤器 返回h之前是否已经在过滤器中
+func (d *doorkeeper) allow(h uint64) bool {
+	present := true
+	for i := 0; i < 2; i++ {
+		idx := indexOf(h, i) & d.mask
+		word, bit := idx/64, uint64(1)<<(idx%64)
+		if d.bits[word]&bit == 0 {
+			present = false
+			d.bits[word] |= bit
+		}
+	}
+	return present
+}
+
+func (d *doorkeeper) contains(h uint64) bool {
+	for i := 0; i < 2; i++ {
+		idx := indexOf(h, i) & d.mask
+		if d.bits[idx/64]&(uint64(1)<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *doorkeeper) reset() {
+	for i := range d.bits {
+		d.bits[i] = 0
+	}
+}
+
+// frequency 组合doorkeeper和sketch 估计key的访问频率
+// 每记录width*10次访问后 所有计数减半 doorkeeper清空
+type frequency struct {
+	sketch     *countMinSketch
+	door       *doorkeeper
+	additions  int
+	sampleSize int
+}
+
+func newFrequency(width int) *frequency {
+	return &frequency{
+		sketch:     newCountMinSketch(width),
+		door:       newDoorkeeper(width),
+		sampleSize: width * 10,
+	}
+}
+
+// record 记录一次对key的访问
+func (f *frequency) record(key string) {
+	h := hashOf(key)
+	if f.door.allow(h) {
+		f.sketch.increment(h)
+	}
+	f.additions++
+	if f.additions >= f.sampleSize {
+		f.sketch.halve()
+		f.door.reset()
+		f.additions /= 2
+	}
+}
+
+// estimate 返回key的访问频率估计值
+func (f *frequency) estimate(key string) int {
+	h := hashOf(key)
+	n := int(f.sketch.estimate(h))
+	if f.door.contains(h) {
+		n++
+	}
+	return n
+}
+
+func hashOf(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// indexOf 由一个哈希值派生出第i个哈希值(double hashing)
+func indexOf(h uint64, i int) uint64 {
+	h2 := h>>32 | 1
+	return h + uint64(i)*h2
+}
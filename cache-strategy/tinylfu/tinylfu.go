@@ -0,0 +1,383 @@
+package tinylfu
+
+// tinylfu 包实现了W-TinyLFU算法的缓存
+// 新数据先进入一个很小的窗口LRU(window) 以吸收突发的访问
+// 从窗口淘汰的数据作为候选者 与主缓存probation段末尾的受害者比较访问频率
+// 频率更高者留在主缓存 主缓存是分段LRU: probation(试用)和protected(保护)
+// 频率由带doorkeeper的count-min sketch估计 并定期减半 所以曾经热门但不再访问的数据会老化
+// Warning: tinylfu包不提供并发一致机制
+
+import (
+	"container/list"
+	cachestrategy "simple-groupcache/cache-strategy"
+	"time"
+)
+
+const (
+	windowPercent    = 1  // 窗口占总容量的百分比
+	protectedPercent = 80 // protected段占主缓存容量的百分比
+
+	// 估计平均每个缓存项的大小 用于确定sketch的宽度
+	avgEntryBytes = 64
+	minWidth      = 1 << 8
+	maxWidth      = 1 << 20
+)
+
+// EntryOverhead 估计的每条缓存的结构开销(字节)
+// list.Element(40) + Node(64) + map中key/指针及桶的均摊(32)
+const EntryOverhead = 136
+
+type segment int
+
+const (
+	window segment = iota
+	probation
+	protected
+)
+
+// Node 定义双向链表节点所存储的对象
+type Node struct {
+	key     string
+	value   cachestrategy.Lengthable
+	expire  time.Time // 过期时间 零值表示永不过期
+	segment segment   // 所在的段
+}
+
+func (n *Node) size() int64 {
+	return int64(len(n.key)) + int64(n.value.Len())
+}
+
+// Cache 是W-TinyLFU算法实现的缓存
+type Cache struct {
+	MaxByte        int64 // Cache 最大容量(Byte)
+	CurrByte       int64 // Cache 当前容量(Byte) 只计key+value
+	MaxEntries     int64 // Cache 最大条目数 0表示不限制
+	chargeOverhead bool  // 容量检查时是否计入EntryOverhead
+
+	hashmap       map[string]*list.Element
+	lists         [3]*list.List // 各段的链表 链头表示最近使用
+	bytes         [3]int64      // 各段占用的字节数 chargeOverhead时包含结构开销
+	maxBytes      [3]int64      // 各段的容量 主缓存的容量是probation与protected之和
+	windowEntries int64         // 窗口的最大条目数 仅在MaxEntries不为0时有效
+	freq          *frequency
+
+	callback cachestrategy.OnEvicted // 淘汰回调
+	clock    cachestrategy.Clock     // 判断过期的时钟
+}
+
+var _ cachestrategy.CacheStrategy = (*Cache)(nil)
+
+func init() {
+	cachestrategy.Register("tinylfu", func(maxBytes int64, callback cachestrategy.OnEvicted) cachestrategy.CacheStrategy {
+		return New(maxBytes, callback)
+	})
+}
+
+// New 创建指定最大容量的W-TinyLFU缓存
+// 当maxBytes为0时，代表cache无内存限制，无限存放
+func New(maxBytes int64, callback cachestrategy.OnEvicted) *Cache {
+	width := minWidth
+	for width < maxWidth && int64(width) < maxBytes/avgEntryBytes {
+		width <<= 1
+	}
+	c := &Cache{
+		hashmap:  make(map[string]*list.Element),
+		freq:     newFrequency(width),
+		callback: callback,
+		clock:    cachestrategy.SystemClock,
+	}
+	for i := range c.lists {
+		c.lists[i] = list.New()
+	}
+	c.setMaxBytes(maxBytes)
+	return c
+}
+
+// setMaxBytes 按比例重新划分各段的容量
+// sketch的宽度不随之调整 频率估计只是略微不准
+func (c *Cache) setMaxBytes(maxBytes int64) {
+	c.MaxByte = maxBytes
+	c.maxBytes[window] = maxBytes * windowPercent / 100
+	mainBytes := maxBytes - c.maxBytes[window]
+	c.maxBytes[protected] = mainBytes * protectedPercent / 100
+	c.maxBytes[probation] = mainBytes - c.maxBytes[protected]
+}
+
+// SetLimits 设置容量上限 并立即淘汰超出部分
+func (c *Cache) SetLimits(limits cachestrategy.Limits) {
+	if limits.ChargeOverhead != c.chargeOverhead {
+		// 各段的字节数口径变了 重新统计
+		c.chargeOverhead = limits.ChargeOverhead
+		for seg, l := range c.lists {
+			c.bytes[seg] = 0
+			for elem := l.Front(); elem != nil; elem = elem.Next() {
+				c.bytes[seg] += c.sizeOf(elem.Value.(*Node))
+			}
+		}
+	}
+	c.setMaxBytes(limits.MaxBytes)
+	c.MaxEntries = limits.MaxEntries
+	c.windowEntries = limits.MaxEntries * windowPercent / 100
+	if c.windowEntries < 1 {
+		c.windowEntries = 1
+	}
+	c.evict()
+}
+
+// sizeOf 返回节点在容量检查时的字节数
+func (c *Cache) sizeOf(n *Node) int64 {
+	if c.chargeOverhead {
+		return n.size() + EntryOverhead
+	}
+	return n.size()
+}
+
+// windowOverflow 窗口是否超出容量
+func (c *Cache) windowOverflow() bool {
+	return (c.MaxByte != 0 && c.bytes[window] > c.maxBytes[window]) ||
+		(c.MaxEntries != 0 && int64(c.lists[window].Len()) > c.windowEntries)
+}
+
+// mainBytes 返回主缓存(probation+protected)的字节数上限
+func (c *Cache) mainBytes() int64 {
+	return c.maxBytes[probation] + c.maxBytes[protected]
+}
+
+// tooLarge 单个数据超过主缓存的容量时 无论如何淘汰都放不下
+// 如果让它参与准入 会先把主缓存清空 最后再淘汰自己
+func (c *Cache) tooLarge(n *Node) bool {
+	return c.MaxByte != 0 && c.sizeOf(n) > c.mainBytes()
+}
+
+// mainOverflow 主缓存是否超出容量
+func (c *Cache) mainOverflow() bool {
+	return (c.MaxByte != 0 && c.bytes[probation]+c.bytes[protected] > c.mainBytes()) ||
+		(c.MaxEntries != 0 && int64(c.lists[probation].Len()+c.lists[protected].Len()) > c.MaxEntries-c.windowEntries)
+}
+
+// SetClock 设置判断过期所使用的时钟
+func (c *Cache) SetClock(clock cachestrategy.Clock) {
+	c.clock = clock
+}
+
+// Len 返回当前缓存元素个数
+func (c *Cache) Len() int64 {
+	return int64(len(c.hashmap))
+}
+
+// Bytes 返回当前缓存占用的字节数
+func (c *Cache) Bytes() int64 {
+	return c.CurrByte
+}
+
+// ResidentBytes 返回估计的实际内存占用
+func (c *Cache) ResidentBytes() int64 {
+	return c.CurrByte + c.Len()*EntryOverhead
+}
+
+// Contains,看看key存不存在(不访问)
+func (c *Cache) Contains(key string) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Peek 获取key对应的value 既不记录频率也不移动链表节点
+func (c *Cache) Peek(key string) (value cachestrategy.Lengthable, ok bool) {
+	if elem, ok := c.hashmap[key]; ok {
+		node := elem.Value.(*Node)
+		if !cachestrategy.Expired(node.expire, c.clock.Now()) {
+			return node.value, true
+		}
+	}
+	return nil, false
+}
+
+// Keys 按淘汰顺序返回所有key
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, len(c.hashmap))
+	c.Range(func(key string, _ cachestrategy.Lengthable) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range 按Evict的顺序遍历: probation 窗口 protected 各段内从链尾到链头 跳过已过期的缓存
+// 实际淘汰时窗口中的候选者还要与受害者比较频率 所以这只是近似的淘汰顺序
+func (c *Cache) Range(fn func(key string, value cachestrategy.Lengthable) bool) {
+	now := c.clock.Now()
+	for _, seg := range []segment{probation, window, protected} {
+		for elem := c.lists[seg].Back(); elem != nil; elem = elem.Prev() {
+			node := elem.Value.(*Node)
+			if cachestrategy.Expired(node.expire, now) {
+				continue
+			}
+			if !fn(node.key, node.value) {
+				return
+			}
+		}
+	}
+}
+
+// Get 从缓存获取对应key的value
+// ok 指明查询结果 false代表查无此key
+func (c *Cache) Get(key string) (value cachestrategy.Lengthable, ok bool) {
+	c.freq.record(key)
+	elem, ok := c.hashmap[key]
+	if !ok {
+		return nil, false
+	}
+	node := elem.Value.(*Node)
+	if cachestrategy.Expired(node.expire, c.clock.Now()) {
+		c.removeElement(elem, cachestrategy.EvictExpired)
+		return nil, false
+	}
+	c.access(elem)
+	return node.value, true
+}
+
+// Add 向缓存添加/更新一枚key-value
+func (c *Cache) Add(key string, value cachestrategy.Lengthable, expire time.Time) {
+	c.freq.record(key)
+	// 单个数据超过主缓存的容量 直接丢弃 已有的旧值也一并删除
+	if c.tooLarge(&Node{key: key, value: value}) {
+		if elem, ok := c.hashmap[key]; ok {
+			c.removeElement(elem, cachestrategy.EvictReplaced)
+		}
+		return
+	}
+	if elem, ok := c.hashmap[key]; ok {
+		node := elem.Value.(*Node)
+		delta := int64(value.Len()) - int64(node.value.Len())
+		c.bytes[node.segment] += delta
+		c.CurrByte += delta
+		oldValue := node.value
+		node.value = value
+		node.expire = expire
+		if c.callback != nil {
+			c.callback(key, oldValue, cachestrategy.EvictReplaced)
+		}
+		c.access(elem)
+	} else {
+		// 新数据总是先进入窗口
+		node := &Node{key: key, value: value, expire: expire, segment: window}
+		c.hashmap[key] = c.lists[window].PushFront(node)
+		c.bytes[window] += c.sizeOf(node)
+		c.CurrByte += node.size()
+	}
+	c.evict()
+}
+
+// access 处理一次命中: 窗口和protected中移到链头 probation中晋升到protected
+func (c *Cache) access(elem *list.Element) {
+	node := elem.Value.(*Node)
+	switch node.segment {
+	case window, protected:
+		c.lists[node.segment].MoveToFront(elem)
+	case probation:
+		elem = c.move(elem, protected)
+		// protected溢出时 将其末尾的数据降级回probation
+		for c.MaxByte != 0 && c.bytes[protected] > c.maxBytes[protected] && c.lists[protected].Len() > 1 {
+			c.move(c.lists[protected].Back(), probation)
+		}
+	}
+}
+
+// evict 在容量不足时淘汰缓存
+func (c *Cache) evict() {
+	if c.MaxByte == 0 && c.MaxEntries == 0 {
+		return
+	}
+	// 窗口溢出的数据进入probation 成为候选者
+	for c.windowOverflow() {
+		candidate := c.move(c.lists[window].Back(), probation)
+		// 缩小容量后 窗口中可能有放不进主缓存的数据 直接淘汰它
+		if c.tooLarge(candidate.Value.(*Node)) {
+			c.removeElement(candidate, cachestrategy.EvictCapacity)
+			continue
+		}
+		// 主缓存溢出时 候选者与受害者比较频率 频率低者被淘汰
+		for c.mainOverflow() {
+			victim := c.lists[probation].Back()
+			if victim == candidate {
+				if c.lists[protected].Len() == 0 {
+					c.removeElement(candidate, cachestrategy.EvictCapacity)
+					break
+				}
+				victim = c.lists[protected].Back()
+			}
+			candidateNode, victimNode := candidate.Value.(*Node), victim.Value.(*Node)
+			if c.freq.estimate(candidateNode.key) > c.freq.estimate(victimNode.key) {
+				c.removeElement(victim, cachestrategy.EvictCapacity)
+			} else {
+				c.removeElement(candidate, cachestrategy.EvictCapacity)
+				break
+			}
+		}
+	}
+	// 更新已有数据或缩小容量也可能使主缓存溢出 此时直接淘汰末尾的数据
+	for c.mainOverflow() {
+		if elem := c.lists[probation].Back(); elem != nil {
+			c.removeElement(elem, cachestrategy.EvictCapacity)
+		} else {
+			c.removeElement(c.lists[protected].Back(), cachestrategy.EvictCapacity)
+		}
+	}
+}
+
+// Evict 淘汰一枚缓存 优先淘汰probation末尾的数据
+func (c *Cache) Evict() (string, cachestrategy.Lengthable) {
+	for _, seg := range []segment{probation, window, protected} {
+		if elem := c.lists[seg].Back(); elem != nil {
+			node := elem.Value.(*Node)
+			c.removeElement(elem, cachestrategy.EvictCapacity)
+			return node.key, node.value
+		}
+	}
+	return "", nil
+}
+
+// Remove 删除特定key的数据
+func (c *Cache) Remove(key string) {
+	if elem, ok := c.hashmap[key]; ok {
+		c.removeElement(elem, cachestrategy.EvictRemoved)
+	}
+}
+
+// RemoveExpired 清理所有已过期的缓存 返回清理的个数
+func (c *Cache) RemoveExpired() int {
+	now := c.clock.Now()
+	count := 0
+	for _, elem := range c.hashmap {
+		if cachestrategy.Expired(elem.Value.(*Node).expire, now) {
+			c.removeElement(elem, cachestrategy.EvictExpired)
+			count++
+		}
+	}
+	return count
+}
+
+// move 将节点移动到seg段的链头 返回新的链表节点
+func (c *Cache) move(elem *list.Element, seg segment) *list.Element {
+	node := elem.Value.(*Node)
+	c.lists[node.segment].Remove(elem)
+	c.bytes[node.segment] -= c.sizeOf(node)
+	node.segment = seg
+	elem = c.lists[seg].PushFront(node)
+	c.bytes[seg] += c.sizeOf(node)
+	c.hashmap[node.key] = elem
+	return elem
+}
+
+// removeElement 移除链表节点及其映射 并更新占用内存情况
+// reason 是移出的原因 会传给回调
+func (c *Cache) removeElement(elem *list.Element, reason cachestrategy.EvictReason) {
+	node := elem.Value.(*Node)
+	c.lists[node.segment].Remove(elem)
+	delete(c.hashmap, node.key)
+	c.bytes[node.segment] -= c.sizeOf(node)
+	c.CurrByte -= node.size()
+	if c.callback != nil {
+		c.callback(node.key, node.value, reason)
+	}
+}
@@ -0,0 +1,173 @@
+package tinylfu
+
+import (
+	"fmt"
+	"reflect"
+	cachestrategy "simple-groupcache/cache-strategy"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestGet(t *testing.T) {
+	cache := New(int64(0), nil)
+	cache.Add("key1", String("1234"), time.Time{})
+	if v, ok := cache.Get("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, ok := cache.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	cache := New(int64(0), nil)
+	cache.Add("key", String("1"), time.Time{})
+	cache.Add("key", String("111"), time.Time{})
+
+	if cache.CurrByte != int64(len("key")+len("111")) {
+		t.Fatal("expected 6 but got", cache.CurrByte)
+	}
+}
+
+func TestOnEvicted(t *testing.T) {
+	keys := make([]string, 0)
+	callback := func(key string, value cachestrategy.Lengthable, _ cachestrategy.EvictReason) {
+		keys = append(keys, key)
+	}
+	cache := New(int64(400), callback)
+	for i := 0; i < 100; i++ {
+		cache.Add(fmt.Sprintf("k%02d", i), String("v"), time.Time{})
+	}
+	if cache.CurrByte > cache.MaxByte {
+		t.Fatalf("cache exceeds capacity: %d > %d", cache.CurrByte, cache.MaxByte)
+	}
+	if int64(len(keys))+cache.Len() != 100 {
+		t.Fatalf("expected %d evictions, got %d", 100-cache.Len(), len(keys))
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	cache := New(int64(1000), nil)
+	// 热门数据被访问多次
+	hot := make([]string, 10)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot%02d", i)
+		for j := 0; j < 5; j++ {
+			if _, ok := cache.Get(hot[i]); !ok {
+				cache.Add(hot[i], String("value"), time.Time{})
+			}
+		}
+	}
+	// 大量只访问一次的数据扫过缓存
+	for i := 0; i < 1000; i++ {
+		cache.Add(fmt.Sprintf("scan%04d", i), String("value"), time.Time{})
+	}
+	for _, key := range hot {
+		if !cache.Contains(key) {
+			t.Fatalf("hot key %s was evicted by a scan", key)
+		}
+	}
+}
+
+func TestFrequencyAging(t *testing.T) {
+	f := newFrequency(minWidth)
+	for i := 0; i < 10; i++ {
+		f.record("key")
+	}
+	before := f.estimate("key")
+	// 大量其他访问触发计数减半
+	for i := 0; i < f.sampleSize; i++ {
+		f.record(fmt.Sprint(i))
+	}
+	if after := f.estimate("key"); after >= before {
+		t.Fatalf("frequency should decay, before %d after %d", before, after)
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestExpire(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	keys := make([]string, 0)
+	cache := New(int64(0), func(key string, value cachestrategy.Lengthable, reason cachestrategy.EvictReason) {
+		if reason == cachestrategy.EvictExpired {
+			keys = append(keys, key)
+		}
+	})
+	cache.SetClock(clock)
+	cache.Add("k1", String("v1"), clock.now.Add(time.Second))
+	cache.Add("k2", String("v2"), clock.now.Add(time.Minute))
+
+	clock.now = clock.now.Add(time.Second)
+	if _, ok := cache.Get("k1"); ok {
+		t.Fatalf("k1 should be expired")
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if n := cache.RemoveExpired(); n != 1 || cache.Len() != 0 || cache.CurrByte != 0 {
+		t.Fatalf("expected 1 expired entry removed, got %d", n)
+	}
+	if !reflect.DeepEqual(keys, []string{"k1", "k2"}) {
+		t.Fatalf("expired entries should be reported as evicted, got %v", keys)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cache := New(int64(0), nil)
+	cache.SetLimits(cachestrategy.Limits{MaxEntries: 10})
+	for i := 0; i < 100; i++ {
+		cache.Add(fmt.Sprintf("k%02d", i), String("v"), time.Time{})
+	}
+	if cache.Len() > 10 {
+		t.Fatalf("max entries should be enforced, got %d", cache.Len())
+	}
+
+	cache.SetLimits(cachestrategy.Limits{MaxBytes: 2000, ChargeOverhead: true})
+	for i := 0; i < 100; i++ {
+		cache.Add(fmt.Sprintf("k%02d", i), String("v"), time.Time{})
+	}
+	if cache.ResidentBytes() > 2000 {
+		t.Fatalf("resident bytes %d exceeds 2000", cache.ResidentBytes())
+	}
+}
+
+func TestOversize(t *testing.T) {
+	keys := make([]string, 0)
+	cache := New(int64(1000), func(key string, value cachestrategy.Lengthable, reason cachestrategy.EvictReason) {
+		keys = append(keys, key)
+	})
+	for i := 0; i < 10; i++ {
+		cache.Add(fmt.Sprintf("k%02d", i), String("v"), time.Time{})
+	}
+	// 超过主缓存容量的数据被直接丢弃 不会冲掉已有的数据
+	big := String(make([]byte, 995))
+	for i := 0; i < 5; i++ {
+		cache.Add("big", big, time.Time{})
+	}
+	if cache.Contains("big") || cache.Len() != 10 || len(keys) != 0 {
+		t.Fatalf("oversized entry should be rejected, got %d entries, evicted %v", cache.Len(), keys)
+	}
+}
+
+func TestPeekRange(t *testing.T) {
+	cache := New(int64(0), nil)
+	cache.Add("k1", String("v1"), time.Time{})
+	cache.Add("k2", String("v2"), time.Time{})
+	if v, ok := cache.Peek("k1"); !ok || string(v.(String)) != "v1" || !cache.Contains("k2") {
+		t.Fatalf("peek k1 failed")
+	}
+	if keys := cache.Keys(); !reflect.DeepEqual(keys, []string{"k1", "k2"}) {
+		t.Fatalf("expected keys in eviction order, got %v", keys)
+	}
+}
@@ -2,53 +2,230 @@ package simplegroupcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"simple-groupcache/pb"
 	"simple-groupcache/registry"
+	"sync"
 	"time"
 
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 // client 模块实现节点访问其他远程节点 从而获取缓存的能力
 
+// defaultRPCTimeout 调用方未设置deadline时 RPC调用的超时时间
+const defaultRPCTimeout = 10 * time.Second
+
+// client 持有与远端节点之间长期存在的连接 可以被并发使用
+// 连接在第一次使用时才建立 断开后由grpc自动重连
 type client struct {
-	name string // 服务名称 pcache/ip:addr
+	name     string            // 服务名称 pcache/ip:addr
+	service  string            // 远端节点注册的服务名
+	addr     string            // 远端节点地址 ip:port
+	registry registry.Registry // 用于确认远端节点已注册
+	timeout  time.Duration     // 调用方未设置deadline时的超时时间
+	dialOpts []grpc.DialOption // 连接远端节点的额外选项
+
+	mu         sync.Mutex
+	conn       *grpc.ClientConn
+	grpcClient pb.GroupcacheClient
+	closed     bool // close后为true 之后的调用直接失败 不再重新建立连接
 }
 
-func NewClient(service string) *client {
-	return &client{name: service}
+// NewClient 创建访问注册在service下的节点addr的client
+func NewClient(service string, addr string, r registry.Registry) *client {
+	return &client{
+		name:     fmt.Sprintf("%s/%s", service, addr),
+		service:  service,
+		addr:     addr,
+		registry: r,
+		timeout:  defaultRPCTimeout,
+	}
 }
 
-// Fetch 从remote peer获取对应缓存值
-func (c *client) Fetch(group string, key string) ([]byte, error) {
-	// 创建一个etcd client
-	cli, err := clientv3.New(defaultEtcdConfig)
-	if err != nil {
+// getClient 返回与远端节点连接的grpc client
+// 连接不存在时 先通过registry确认远端节点已注册 再建立连接
+func (c *client) getClient(ctx context.Context) (pb.GroupcacheClient, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("peer %s: client closed", c.name)
+	}
+	grpcClient := c.grpcClient
+	c.mu.Unlock()
+	if grpcClient != nil {
+		return grpcClient, nil
+	}
+	// 在锁外查询registry 查询很慢时也不会阻塞其他调用和close
+	if err := c.resolve(ctx); err != nil {
 		return nil, err
 	}
-	defer cli.Close()
-	// 发现服务 取得与服务的连接
-	conn, err := registry.EtcdDial(cli, c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("peer %s: client closed", c.name)
+	}
+	if c.conn == nil {
+		// 非阻塞建立连接 连接真正建立前的RPC会等待直到ctx超时
+		opts := append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, c.dialOpts...)
+		conn, err := grpc.Dial(c.addr, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("dial peer %s failed: %v", c.name, err)
+		}
+		c.conn = conn
+		c.grpcClient = pb.NewGroupcacheClient(conn)
+	}
+	return c.grpcClient, nil
+}
+
+// resolve 确认远端节点已注册在registry中
+func (c *client) resolve(ctx context.Context) error {
+	if c.registry == nil {
+		return nil
+	}
+	addrs, err := c.registry.Resolve(ctx, c.service)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("resolve peer %s failed: %v", c.name, err)
 	}
-	defer conn.Close()
+	for _, addr := range addrs {
+		if addr == c.addr {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %s not registered", c.name)
+}
 
-	// 创建grpc client
-	grpcClient := pb.NewGroupcacheClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	// 发送请求
-	resp, err := grpcClient.Get(ctx, &pb.GetRequest{
-		Group: group,
-		Key:   key,
-	})
+// close 关闭与远端节点的连接 关闭后client不能再使用
+func (c *client) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.grpcClient = nil, nil
+	return err
+}
+
+// call 使用与远端节点连接的grpc client执行fn
+// 如果ctx没有设置deadline 则使用默认的超时时间
+func (c *client) call(ctx context.Context, fn func(ctx context.Context, grpcClient pb.GroupcacheClient) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	grpcClient, err := c.getClient(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("could not get %s/%s from peer %s", group, key, c.name)
+		return err
 	}
+	return fn(ctx, grpcClient)
+}
+
+// Fetch 从remote peer获取对应缓存值
+func (c *client) Fetch(ctx context.Context, group string, key string) (Result, error) {
+	var res Result
+	err := c.call(ctx, func(ctx context.Context, grpcClient pb.GroupcacheClient) error {
+		// 发送请求
+		resp, err := grpcClient.Get(ctx, &pb.GetRequest{
+			Group: group,
+			Key:   key,
+		})
+		if err != nil {
+			return fmt.Errorf("could not get %s/%s from peer %s: %v", group, key, c.name, err)
+		}
+		res = Result{
+			Value:   resp.GetValue(),
+			Expire:  expireTime(resp.GetExpire()),
+			Version: resp.GetVersion(),
+			NoStore: resp.GetNoStore(),
+		}
+		return nil
+	})
+	return res, err
+}
+
+// FetchMulti 从remote peer批量获取缓存值
+// 远端节点返回的"不存在"错误仍满足errors.Is(err, ErrNotFound)
+func (c *client) FetchMulti(ctx context.Context, group string, keys []string) ([]FetchResult, error) {
+	var results []FetchResult
+	err := c.call(ctx, func(ctx context.Context, grpcClient pb.GroupcacheClient) error {
+		resp, err := grpcClient.GetMulti(ctx, &pb.GetMultiRequest{
+			Group: group,
+			Keys:  keys,
+		})
+		if err != nil {
+			return fmt.Errorf("could not get %d keys of %s from peer %s: %v", len(keys), group, c.name, err)
+		}
+		if len(resp.GetResults()) != len(keys) {
+			return fmt.Errorf("peer %s returned %d results for %d keys", c.name, len(resp.GetResults()), len(keys))
+		}
+		results = make([]FetchResult, len(keys))
+		for i, r := range resp.GetResults() {
+			switch {
+			case r.GetNotFound():
+				results[i].Err = &notFoundError{msg: r.GetError()}
+			case r.GetError() != "":
+				results[i].Err = errors.New(r.GetError())
+			default:
+				results[i].Result = Result{
+					Value:   r.GetValue(),
+					Expire:  expireTime(r.GetExpire()),
+					Version: r.GetVersion(),
+					NoStore: r.GetNoStore(),
+				}
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Set 在remote peer写入缓存值
+func (c *client) Set(ctx context.Context, group string, key string, value []byte) error {
+	return c.call(ctx, func(ctx context.Context, grpcClient pb.GroupcacheClient) error {
+		_, err := grpcClient.Set(ctx, &pb.SetRequest{
+			Group: group,
+			Key:   key,
+			Value: value,
+		})
+		if err != nil {
+			return fmt.Errorf("could not set %s/%s to peer %s: %v", group, key, c.name, err)
+		}
+		return nil
+	})
+}
 
-	return resp.GetValue(), nil
+// Remove 在remote peer删除缓存值
+func (c *client) Remove(ctx context.Context, group string, key string) error {
+	return c.call(ctx, func(ctx context.Context, grpcClient pb.GroupcacheClient) error {
+		_, err := grpcClient.Remove(ctx, &pb.RemoveRequest{
+			Group: group,
+			Key:   key,
+		})
+		if err != nil {
+			return fmt.Errorf("could not remove %s/%s from peer %s: %v", group, key, c.name, err)
+		}
+		return nil
+	})
+}
+
+// Invalidate 通知remote peer丢弃本地副本
+func (c *client) Invalidate(ctx context.Context, group string, key string) error {
+	return c.call(ctx, func(ctx context.Context, grpcClient pb.GroupcacheClient) error {
+		_, err := grpcClient.Invalidate(ctx, &pb.InvalidateRequest{
+			Group: group,
+			Key:   key,
+		})
+		if err != nil {
+			return fmt.Errorf("could not invalidate %s/%s on peer %s: %v", group, key, c.name, err)
+		}
+		return nil
+	})
 }
 
 // 测试Client是否实现了Fetcher接口
@@ -1,10 +1,18 @@
 package simplegroupcache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"simple-groupcache/bloomfilter"
+	cachestrategy "simple-groupcache/cache-strategy"
 	"simple-groupcache/singlefilght"
 )
 
@@ -16,43 +24,395 @@ var (
 	groups = make(map[string]*Group)
 )
 
-// Retriever 要求对象实现从数据源获取数据的能力
-type Retriever interface {
-	retrieve(string) ([]byte, error)
+// RetrieverFunc 是只返回数据的数据源 任意匿名函数func
+// 通过被RetrieverFunc(func)类型强制转换后 即实现了 Getter 接口
+type RetrieverFunc func(key string) ([]byte, error)
+
+// Get 使 RetrieverFunc 实现了 Getter 接口
+// 这样只返回数据的旧数据源无需修改即可继续使用 其结果总是按Group的默认配置缓存
+// RetrieverFunc 不感知context 因此ctx会被忽略
+func (f RetrieverFunc) Get(_ context.Context, key string) (Result, error) {
+	bytes, err := f(key)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Value: bytes}, nil
 }
 
-type RetrieverFunc func(key string) ([]byte, error)
+// Result 是数据源返回的结果 除了数据本身 还携带了数据源对缓存的要求
+type Result struct {
+	Value   []byte
+	Expire  time.Time // 过期时间 零值表示使用Group的默认过期时长
+	Version int64     // 数据的版本号 随缓存值一起保存
+	NoStore bool      // 为true时结果只返回给调用方 不写入缓存
+}
+
+// Getter 要求对象实现从数据源获取数据及其元信息的能力
+// ctx 携带了调用方的deadline和取消信号 数据源应当遵守
+type Getter interface {
+	Get(ctx context.Context, key string) (Result, error)
+}
+
+type GetterFunc func(ctx context.Context, key string) (Result, error)
+
+// GetterFunc 使得任意匿名函数func通过类型转换后实现 Getter 接口
+func (f GetterFunc) Get(ctx context.Context, key string) (Result, error) {
+	return f(ctx, key)
+}
+
+// ErrNotFound 表示key在数据源中不存在
+// 数据源返回包装了ErrNotFound的错误时 开启了负缓存的 Group 会记住这次未命中
+var ErrNotFound = errors.New("not found")
+
+// notFoundError 是负缓存命中时返回的错误 保留了数据源原来的错误信息
+type notFoundError struct {
+	msg string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
 
-// RetrieverFunc 通过实现retrieve方法，使得任意匿名函数func
-// 通过被RetrieverFunc(func)类型强制转换后，实现了 Retriever 接口的能力
-func (f RetrieverFunc) retrieve(key string) ([]byte, error) {
-	return f(key)
+// Is 使errors.Is(err, ErrNotFound)成立
+func (e *notFoundError) Is(target error) bool {
+	return target == ErrNotFound
 }
 
+// EvictReason 说明缓存被移出的原因
+type EvictReason = cachestrategy.EvictReason
+
+const (
+	EvictCapacity = cachestrategy.EvictCapacity // 容量不足被淘汰
+	EvictExpired  = cachestrategy.EvictExpired  // 已过期被清理
+	EvictRemoved  = cachestrategy.EvictRemoved  // 被Remove或失效通知删除
+	EvictReplaced = cachestrategy.EvictReplaced // 被新写入的值替换 value是旧值
+)
+
+// EvictionListener 在缓存被移出cache时调用 可用于回写/统计/溢出到二级存储
+// 调用时不持有cache的锁 但会阻塞触发移出的那次操作 耗时的处理应交给其他协程
+type EvictionListener func(key string, value ByteView, reason EvictReason)
+
 // Group 提供命名管理缓存/填充缓存的能力
 type Group struct {
 	name      string // 命名空间
 	cache     *mutexCache
-	retriever Retriever
+	retriever Getter
 	server    Picker               // 实现了Picker接口的Server
 	flight    *singlefilght.Flight // 防止缓存击穿
+	stats     groupStats           // 统计信息
+
+	// hotCache 保存从远端节点取回的热门key的副本 避免每次都经过网络
+	// 它与cache分开计算容量 这样热门远端key不会挤占本节点所属的key
+	hotCache      *mutexCache
+	hotCacheBytes int64         // hotCache的容量 0表示禁用
+	hotSampleRate float64       // 远端取回的值以该概率写入hotCache
+	hotTTL        time.Duration // hotCache中副本的最长保留时间 0表示只遵守所属节点给出的过期时间
+
+	strategy       cachestrategy.CacheStrategy // 通过WithStrategy传入的缓存策略实例
+	shards         int                         // cache的分片数
+	maxEntries     int64                       // cache的最大条目数 0表示不限制
+	chargeOverhead bool                        // 容量是否计入每条缓存的结构开销
+	agingOps       int64                       // 每agingOps次访问衰减一次频率
+	agingPeriod    time.Duration               // 每经过agingPeriod衰减一次频率
+	memory         *MemoryManager              // 共享内存上限的管理者 nil表示不受管理
+	memoryWeight   float64                     // 在memory中的权重
+	listeners      []EvictionListener          // cache的移出监听者
+	ttl            time.Duration               // 缓存默认过期时长 0表示永不过期
+	softTTL        time.Duration               // 写入后经过softTTL值变旧 0表示不启用stale-while-revalidate
+	staleIfError   time.Duration               // 过期后仍保留旧值的时长 加载失败时返回旧值
+	earlyBeta      float64                     // 提前刷新的系数 0表示不提前刷新
+	expiryJitter   time.Duration               // 默认过期时间随机提前的最大时长
+	refreshing     sync.Map                    // 正在后台刷新的key 同一key只刷新一次
+	clock          cachestrategy.Clock         // 计算过期时间所用的时钟
+	reapInterval   time.Duration               // 后台清理过期缓存的间隔
+	loadTimeout    time.Duration               // 共享加载的超时时间 0表示不限制
+	loadingMu      sync.Mutex                  // 保护loading
+	loading        map[string]*sharedContext   // 正在加载的key所共享的ctx
+
+	// negCache 记住数据源返回的"不存在" 防止不存在的key每次都打到数据源(缓存穿透)
+	// 它与cache分开计算容量 大量不存在的key不会挤掉真实的缓存
+	negCache      *mutexCache
+	negTTL        time.Duration    // 负缓存的过期时长 0表示禁用
+	negBytes      int64            // negCache的容量 0表示禁用
+	negClassifier func(error) bool // 判断数据源的错误是否表示key不存在
+
+	// bloom 记录所有合法的key 不在其中的key在加载前就被拒绝 nil表示禁用
+	// 读取是无锁的 重建时整体替换
+	bloom         atomic.Pointer[bloomfilter.Filter]
+	bloomMu       sync.Mutex          // 串行化对bloom的写入和重建
+	bloomBuilding *bloomfilter.Filter // 正在重建的过滤器 重建期间Add的key也写入它
+	bloomKeys     int                 // 预计的key数量
+	bloomFPRate   float64             // 期望的误判率
+}
+
+const (
+	defaultReapInterval = time.Minute
+	// 与groupcache一致 hotCache默认占cache容量的1/8 远端取回的值有1/10的概率写入
+	defaultHotCacheRatio = 8
+	defaultHotSampleRate = 0.1
+	// hotCache中的副本最多保留1分钟 即使所属节点没有给出过期时间 数据源的变化也能被看到
+	defaultHotCacheTTL = time.Minute
+)
+
+// GroupOption 用于配置 Group 的可选项
+type GroupOption func(g *Group)
+
+// WithTTL 设置缓存的默认过期时长 过期后Get会重新通过数据源加载
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.ttl = ttl
+	}
+}
+
+// WithStaleWhileRevalidate 开启stale-while-revalidate 写入后经过softTTL值变旧
+// 变旧但未过期的值会被Get立即返回 同时在后台通过singleflight刷新一次
+// softTTL应小于WithTTL或数据源给出的过期时长 否则值过期前不会变旧
+func WithStaleWhileRevalidate(softTTL time.Duration) GroupOption {
+	return func(g *Group) {
+		g.softTTL = softTTL
+	}
+}
+
+// WithStaleIfError 开启stale-if-error 值过期后仍在cache中保留window时长
+// 期间Get会照常重新加载 加载失败(远端节点和数据源都失败)时返回这个旧值
+// 数据源返回"不存在"或调用方取消时不返回旧值
+func WithStaleIfError(window time.Duration) GroupOption {
+	return func(g *Group) {
+		g.staleIfError = window
+	}
+}
+
+// WithEarlyRefresh 开启概率性提前刷新(XFetch) 值过期前就有一定概率在后台刷新
+// 越接近过期 加载越慢(Group记录了每个值的加载耗时) 提前刷新的概率越高
+// 这样同时写入的key不会在同一时刻过期后一起打到数据源 beta通常取1 越大越提前
+func WithEarlyRefresh(beta float64) GroupOption {
+	return func(g *Group) {
+		g.earlyBeta = beta
+	}
+}
+
+// WithExpiryJitter 使默认过期时间随机提前[0, jitter) 避免同时写入的key同时过期
+// 只作用于WithTTL的默认过期时长 数据源给出的过期时间保持不变
+func WithExpiryJitter(jitter time.Duration) GroupOption {
+	return func(g *Group) {
+		g.expiryJitter = jitter
+	}
+}
+
+// WithClock 设置 Group 使用的时钟 主要用于测试过期行为
+func WithClock(clock cachestrategy.Clock) GroupOption {
+	return func(g *Group) {
+		g.clock = clock
+	}
+}
+
+// WithReapInterval 设置后台清理过期缓存的间隔
+// interval<=0表示关闭后台清理 过期缓存只在被访问时惰性删除
+func WithReapInterval(interval time.Duration) GroupOption {
+	return func(g *Group) {
+		if interval < 0 {
+			interval = 0
+		}
+		g.reapInterval = interval
+	}
+}
+
+// WithLoadTimeout 设置加载的超时时间
+// 同一key的并发请求共享一次加载 其deadline为所有调用方中最晚的一个 所有调用方都离开后才被取消
+// timeout 在此之上再限制加载的时长 timeout<=0表示不额外限制
+func WithLoadTimeout(timeout time.Duration) GroupOption {
+	return func(g *Group) {
+		g.loadTimeout = timeout
+	}
+}
+
+// WithStrategy 使用一个已创建好的缓存策略实例作为cache 此时NewGroup的cacheStrategy参数被忽略
+// 实例的容量会被设置为NewGroup的maxBytes 淘汰回调由创建者决定 因此Stats中不会统计cache的淘汰数
+func WithStrategy(cache cachestrategy.CacheStrategy) GroupOption {
+	return func(g *Group) {
+		g.strategy = cache
+	}
+}
+
+// WithShards 将cache按key的哈希值分为n个分片 每个分片平分容量并有自己的锁
+// 分片可以让多核并发的Get不再争抢同一把锁 代价是每个分片各自淘汰 淘汰顺序只在分片内有效
+// 默认只有1个分片 使用WithStrategy传入的实例无法分片
+func WithShards(n int) GroupOption {
+	return func(g *Group) {
+		g.shards = n
+	}
+}
+
+// WithMaxEntries 限制cache的最大条目数 与maxBytes同时生效 超出任意一个都会淘汰
+// 大量小缓存时 条目数比字节数更能反映实际内存占用
+func WithMaxEntries(n int64) GroupOption {
+	return func(g *Group) {
+		g.maxEntries = n
+	}
+}
+
+// WithChargeOverhead 设置容量是否计入每条缓存的结构开销(链表节点/map桶等)
+// 开启后maxBytes更接近实际内存占用 而不只是key+value的字节数 对hotCache同样生效
+func WithChargeOverhead(charge bool) GroupOption {
+	return func(g *Group) {
+		g.chargeOverhead = charge
+	}
+}
+
+// WithAging 开启频率衰减 每ops次访问或每经过period时间 将cache中所有数据的访问频率减半
+// 这样昨天热门而今天不再访问的数据也能被淘汰 只有支持衰减的缓存策略(如lfu)可以开启
+func WithAging(ops int64, period time.Duration) GroupOption {
+	return func(g *Group) {
+		g.agingOps = ops
+		g.agingPeriod = period
+	}
+}
+
+// WithEvictionListener 注册cache的移出监听者 可以注册多个 按注册顺序调用
+// hotCache中只是远端数据的副本 其移出不会通知监听者 使用WithStrategy时监听者不生效
+func WithEvictionListener(listener EvictionListener) GroupOption {
+	return func(g *Group) {
+		g.listeners = append(g.listeners, listener)
+	}
+}
+
+// WithNegativeCache 开启负缓存 数据源返回的"不存在"错误会被记住ttl时长
+// 期间同一key的请求直接返回该错误而不再访问数据源 ttl或maxBytes为0表示禁用
+// isNotFound 判断错误是否表示key不存在 为nil时使用errors.Is(err, ErrNotFound)
+func WithNegativeCache(ttl time.Duration, maxBytes int64, isNotFound func(error) bool) GroupOption {
+	return func(g *Group) {
+		g.negTTL = ttl
+		g.negBytes = maxBytes
+		g.negClassifier = isNotFound
+	}
+}
+
+// WithBloomFilter 开启布隆过滤器 预计有expectedKeys个合法的key 误判率为falsePositiveRate
+// 过滤器一开始是空的 需要通过AddKeys或RebuildBloomFilter填入所有合法的key
+// 不在过滤器中的key直接返回ErrNotFound 不会经过singleflight/远端节点/数据源
+func WithBloomFilter(expectedKeys int, falsePositiveRate float64) GroupOption {
+	return func(g *Group) {
+		g.bloomKeys = expectedKeys
+		g.bloomFPRate = falsePositiveRate
+	}
+}
+
+// WithHotCache 设置hotCache的容量和采样率
+// 从远端节点取回的值以sampleRate的概率写入hotCache maxBytes为0表示禁用hotCache
+func WithHotCache(maxBytes int64, sampleRate float64) GroupOption {
+	return func(g *Group) {
+		g.hotCacheBytes = maxBytes
+		g.hotSampleRate = sampleRate
+	}
+}
+
+// WithHotCacheTTL 设置hotCache中副本的最长保留时间 所属节点给出的过期时间更早时以其为准
+// ttl<=0表示只遵守所属节点给出的过期时间 此时所属节点没有设置过期时间的副本永不过期
+func WithHotCacheTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.hotTTL = ttl
+	}
 }
 
 // NewGroup 创建一个新的缓存空间
-func NewGroup(name string, maxBytes int64, cacheStrategy string, retriever Retriever) *Group {
+// cacheStrategy 是通过cachestrategy.Register注册的缓存策略名 为空时使用lru
+func NewGroup(name string, maxBytes int64, cacheStrategy string, retriever Getter, opts ...GroupOption) (*Group, error) {
 	if retriever == nil {
-		panic("Group retriever must be existed!")
+		return nil, fmt.Errorf("group retriever must be existed")
 	}
 	g := &Group{
-		name:      name,
-		cache:     newCache(maxBytes, cacheStrategy),
-		retriever: retriever,
-		flight:    &singlefilght.Flight{},
+		name:          name,
+		retriever:     retriever,
+		flight:        &singlefilght.Flight{},
+		hotCacheBytes: maxBytes / defaultHotCacheRatio,
+		hotSampleRate: defaultHotSampleRate,
+		hotTTL:        defaultHotCacheTTL,
+		clock:         cachestrategy.SystemClock,
+		reapInterval:  defaultReapInterval,
+		shards:        1,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.strategy != nil {
+		g.cache = newCacheWith(g.strategy, maxBytes)
+	} else {
+		cache, err := newCache(maxBytes, cacheStrategy, g.shards, g.listeners...)
+		if err != nil {
+			return nil, err
+		}
+		g.cache = cache
+	}
+	g.setupCache(g.cache)
+	g.cache.setLimits(cachestrategy.Limits{
+		MaxBytes:       maxBytes,
+		MaxEntries:     g.maxEntries,
+		ChargeOverhead: g.chargeOverhead,
+	})
+	if g.agingOps != 0 || g.agingPeriod != 0 {
+		if err := g.cache.setAging(g.agingOps, g.agingPeriod); err != nil {
+			return nil, err
+		}
+	}
+	if g.hotCacheBytes > 0 {
+		hotCache, err := newCache(g.hotCacheBytes, defaultCacheStrategy, g.shards)
+		if err != nil {
+			return nil, err
+		}
+		g.hotCache = g.setupCache(hotCache)
+		g.hotCache.setLimits(cachestrategy.Limits{
+			MaxBytes:       g.hotCacheBytes,
+			ChargeOverhead: g.chargeOverhead,
+		})
+	}
+	if g.negTTL > 0 && g.negBytes > 0 {
+		negCache, err := newCache(g.negBytes, defaultCacheStrategy, g.shards)
+		if err != nil {
+			return nil, err
+		}
+		g.negCache = g.setupCache(negCache)
+		g.negCache.setLimits(cachestrategy.Limits{
+			MaxBytes:       g.negBytes,
+			ChargeOverhead: g.chargeOverhead,
+		})
+		if g.negClassifier == nil {
+			g.negClassifier = func(err error) bool {
+				return errors.Is(err, ErrNotFound)
+			}
+		}
+	}
+	if g.bloomKeys > 0 {
+		g.bloom.Store(bloomfilter.New(g.bloomKeys, g.bloomFPRate))
+	}
+	if g.memory != nil {
+		g.memory.register(g, g.memoryWeight)
 	}
 	mu.Lock()
 	groups[name] = g
 	mu.Unlock()
-	return g
+	return g, nil
+}
+
+// setupCache 将 Group 的时钟和清理间隔配置到mutexCache上
+func (g *Group) setupCache(c *mutexCache) *mutexCache {
+	c.reapInterval = g.reapInterval
+	c.setClock(g.clock)
+	return c
+}
+
+// SetCacheBytes 在运行时修改cache的容量 n为0表示不限制
+// 缩小容量时 超出的缓存会立即按缓存策略的淘汰顺序被淘汰
+// 被 MemoryManager 管理时修改的是 Group 自己的上限 实际容量由 MemoryManager 重新分配
+func (g *Group) SetCacheBytes(n int64) {
+	if g.memory != nil && g.memory.setMaxBytes(g, n) {
+		return
+	}
+	g.cache.setMaxBytes(n)
+}
+
+// CacheBytes 返回cache当前的容量
+func (g *Group) CacheBytes() int64 {
+	return g.cache.maxBytes()
 }
 
 // RegisterSvr 为 Group 注册 Server
@@ -74,52 +434,566 @@ func GetGroup(name string) *Group {
 func DestroyGroup(name string) {
 	g := GetGroup(name)
 	if g != nil {
-		svr := g.server.(*server)
-		svr.Stop()
+		g.cache.close()
+		if g.hotCache != nil {
+			g.hotCache.close()
+		}
+		if g.negCache != nil {
+			g.negCache.close()
+		}
+		if g.memory != nil {
+			g.memory.unregister(g)
+		}
+		if svr, ok := g.server.(*server); ok {
+			svr.Stop()
+			log.Printf("Destroy cache [%s %s]", name, svr.addr)
+		}
 		delete(groups, name)
-		log.Printf("Destroy cache [%s %s]", name, svr.addr)
 	}
 }
 
-func (g *Group) Get(key string) (ByteView, error) {
+// GetResult 是GetMulti中单个key的结果
+type GetResult struct {
+	Value ByteView
+	Err   error
+}
+
+// Get 获取key对应的缓存 未命中时从远端节点或数据源加载
+// ctx 的deadline和取消信号会传递给远端节点的RPC调用及数据源
+func (g *Group) Get(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key required")
 	}
-	if value, ok := g.cache.get(key); ok {
-		log.Println("cache hit")
-		return value, nil
+	if value, done, err := g.lookup(key); done {
+		return value, err
 	}
 	// cache missing, get it another way
-	return g.load(key)
+	return g.loadOrStale(ctx, key)
+}
+
+// GetMulti 批量获取keys 返回每个key的值或错误
+// 本地缓存命中的key直接返回 属于本节点的key并行加载
+// 其余key按所属节点分组 每个远端节点只发送一次批量RPC 各节点之间并行
+// 与逐个调用Get一致 批量RPC失败或单个key失败时改为从本节点的数据源加载 只有"不存在"直接返回
+func (g *Group) GetMulti(ctx context.Context, keys []string) map[string]GetResult {
+	results := make(map[string]GetResult, len(keys))
+	var local []string
+	remote := make(map[Fetcher][]string)
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		if key == "" {
+			results[key] = GetResult{Err: fmt.Errorf("key required")}
+			continue
+		}
+		if value, done, err := g.lookup(key); done {
+			results[key] = GetResult{Value: value, Err: err}
+			continue
+		}
+		// 先占位 重复的key只加载一次
+		results[key] = GetResult{}
+		if g.server != nil {
+			if peer, ok := g.server.PickPeer(ctx, key); ok {
+				remote[peer] = append(remote[peer], key)
+				continue
+			}
+		}
+		local = append(local, key)
+	}
+
+	var mu sync.Mutex
+	set := func(key string, value ByteView, err error) {
+		mu.Lock()
+		results[key] = GetResult{Value: value, Err: err}
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for _, key := range local {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			value, err := g.loadOrStale(ctx, key)
+			set(key, value, err)
+		}(key)
+	}
+	for peer, keys := range remote {
+		wg.Add(1)
+		go func(peer Fetcher, keys []string) {
+			defer wg.Done()
+			g.fetchMulti(ctx, peer, keys, set)
+		}(peer, keys)
+	}
+	wg.Wait()
+	return results
+}
+
+// lookup 在本地的cache/hotCache/负缓存/布隆过滤器中查找key 不会加载数据
+// done为true表示已得到结果 即命中缓存(value)或确定key不存在(err)
+func (g *Group) lookup(key string) (value ByteView, done bool, err error) {
+	g.stats.gets.Add(1)
+	now := g.clock.Now()
+	// 已过期但仍在stale-if-error窗口内的值不算命中 加载失败时才会返回它
+	if value, ok := g.cache.get(key); ok && !value.isExpired(now) {
+		g.stats.cacheHits.Add(1)
+		if value.isStale(now) {
+			g.stats.staleHits.Add(1)
+			g.refresh(key)
+		} else if g.refreshEarly(value, now) {
+			g.stats.earlyRefreshes.Add(1)
+			g.refresh(key)
+		}
+		return value, true, nil
+	}
+	if g.hotCache != nil {
+		if value, ok := g.hotCache.get(key); ok {
+			g.stats.hotCacheHits.Add(1)
+			return value, true, nil
+		}
+	}
+	if g.negCache != nil {
+		if value, ok := g.negCache.get(key); ok {
+			g.stats.negativeHits.Add(1)
+			return ByteView{}, true, &notFoundError{msg: value.String()}
+		}
+	}
+	if bloom := g.bloom.Load(); bloom != nil && !bloom.Has(key) {
+		g.stats.bloomRejects.Add(1)
+		return ByteView{}, true, fmt.Errorf("%w: %s rejected by bloom filter", ErrNotFound, key)
+	}
+	return ByteView{}, false, nil
+}
+
+// loadOrStale 加载key 加载失败时返回stale-if-error窗口内的旧值
+func (g *Group) loadOrStale(ctx context.Context, key string) (ByteView, error) {
+	value, err := g.load(ctx, key)
+	return g.orStale(ctx, key, value, err)
+}
+
+// orStale 加载失败时返回stale-if-error窗口内的旧值 否则原样返回加载结果
+func (g *Group) orStale(ctx context.Context, key string, value ByteView, err error) (ByteView, error) {
+	if err != nil && g.staleIfError > 0 && g.serveStale(ctx, err) {
+		if stale, ok := g.cache.peek(key); ok {
+			g.stats.staleIfErrors.Add(1)
+			log.Printf("fail to load *%s*, serve the stale value, %s.\n", key, err.Error())
+			return stale, nil
+		}
+	}
+	return value, err
+}
+
+// refresh 在后台重新加载变旧或即将过期的key 同一key同时只有一个刷新在进行
+// 刷新失败时旧值保持不变 之后的Get会再次触发刷新
+func (g *Group) refresh(key string) {
+	if _, loading := g.refreshing.LoadOrStore(key, struct{}{}); loading {
+		return
+	}
+	go func() {
+		defer g.refreshing.Delete(key)
+		if _, err := g.load(context.Background(), key); err != nil {
+			log.Printf("fail to refresh *%s*, %s.\n", key, err.Error())
+		}
+	}()
+}
+
+// refreshEarly 按XFetch算法判断是否提前刷新value
+// 当 now - delta*beta*ln(rand) >= expire 时刷新 rand取(0, 1]
+func (g *Group) refreshEarly(value ByteView, now time.Time) bool {
+	if g.earlyBeta <= 0 || value.delta <= 0 || value.expire.IsZero() {
+		return false
+	}
+	gap := -float64(value.delta) * g.earlyBeta * math.Log(1-rand.Float64())
+	return !now.Add(time.Duration(gap)).Before(value.expire)
+}
+
+// serveStale 判断加载失败时能否返回过期的旧值
+// key已不存在或调用方已取消时 旧值没有意义
+func (g *Group) serveStale(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if g.negClassifier != nil {
+		return !g.negClassifier(err)
+	}
+	return !errors.Is(err, ErrNotFound)
+}
+
+// Peek 查看本地缓存(包括hotCache)中key对应的值
+// 不会加载数据 不计入统计 也不改变淘汰顺序 用于调试和管理工具
+func (g *Group) Peek(key string) (ByteView, bool) {
+	// 与lookup一致 已过期但仍在stale-if-error窗口内的值不算存在
+	if value, ok := g.cache.peek(key); ok && !value.isExpired(g.clock.Now()) {
+		return value, true
+	}
+	if g.hotCache != nil {
+		return g.hotCache.peek(key)
+	}
+	return ByteView{}, false
+}
+
+// Keys 返回cache中所有未过期的key 每个分片内按淘汰顺序排列 不包括hotCache
+func (g *Group) Keys() []string {
+	now := g.clock.Now()
+	return g.cache.keys(func(value ByteView) bool {
+		return !value.isExpired(now)
+	})
+}
+
+// AddKeys 将合法的key加入布隆过滤器 未开启布隆过滤器时什么也不做
+func (g *Group) AddKeys(keys ...string) {
+	g.bloomMu.Lock()
+	defer g.bloomMu.Unlock()
+	bloom := g.bloom.Load()
+	if bloom == nil {
+		return
+	}
+	for _, key := range keys {
+		bloom.Add(key)
+		if g.bloomBuilding != nil {
+			g.bloomBuilding.Add(key)
+		}
+	}
+}
+
+// KeyIterator 依次将所有合法的key交给yield yield返回false时应停止遍历
+type KeyIterator func(yield func(key string) bool) error
+
+// RebuildBloomFilter 用iter遍历出的key构建新的布隆过滤器 然后原子地替换旧的
+// 构建期间旧的过滤器继续生效 期间通过AddKeys加入的key同时写入新旧过滤器
+// iter返回error时放弃重建 旧的过滤器保持不变
+func (g *Group) RebuildBloomFilter(iter KeyIterator) error {
+	if g.bloom.Load() == nil {
+		return fmt.Errorf("bloom filter of group %s is not enabled", g.name)
+	}
+	next := bloomfilter.New(g.bloomKeys, g.bloomFPRate)
+	g.bloomMu.Lock()
+	if g.bloomBuilding != nil {
+		g.bloomMu.Unlock()
+		return fmt.Errorf("bloom filter of group %s is being rebuilt", g.name)
+	}
+	g.bloomBuilding = next
+	g.bloomMu.Unlock()
+
+	err := iter(func(key string) bool {
+		next.Add(key)
+		return true
+	})
+
+	g.bloomMu.Lock()
+	defer g.bloomMu.Unlock()
+	g.bloomBuilding = nil
+	if err != nil {
+		return err
+	}
+	g.bloom.Store(next)
+	return nil
+}
+
+// Set 写入key对应的缓存 写操作会被路由到key的所属节点
+// 所属节点写入后会通知其他节点丢弃各自的本地副本
+// 写入的key同时加入本节点的布隆过滤器
+func (g *Group) Set(ctx context.Context, key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key required")
+	}
+	g.AddKeys(key)
+	if g.server != nil {
+		if peer, ok := g.server.PickPeer(ctx, key); ok {
+			g.invalidate(key)
+			return peer.Set(ctx, g.name, key, value)
+		}
+	}
+	return g.setLocally(ctx, key, value)
+}
+
+// Remove 删除key对应的缓存 删除操作会被路由到key的所属节点
+// 所属节点删除后会通知其他节点丢弃各自的本地副本
+func (g *Group) Remove(ctx context.Context, key string) error {
+	if key == "" {
+		return fmt.Errorf("key required")
+	}
+	if g.server != nil {
+		if peer, ok := g.server.PickPeer(ctx, key); ok {
+			g.invalidate(key)
+			return peer.Remove(ctx, g.name, key)
+		}
+	}
+	return g.removeLocally(ctx, key)
+}
+
+// setLocally 作为key的所属节点写入缓存 并广播失效通知
+func (g *Group) setLocally(ctx context.Context, key string, value []byte) error {
+	g.forgetNotFound(key)
+	g.AddKeys(key)
+	g.populateCache(key, ByteView{b: cloneBytes(value)}, g.expireAt())
+	return g.invalidatePeers(ctx, key)
 }
 
-func (g *Group) load(key string) (ByteView, error) {
-	view, err := g.flight.Fly(key, func() (interface{}, error) {
+// removeLocally 作为key的所属节点删除缓存 并广播失效通知
+func (g *Group) removeLocally(ctx context.Context, key string) error {
+	g.invalidate(key)
+	return g.invalidatePeers(ctx, key)
+}
+
+// invalidate 丢弃本地持有的key的缓存 包括hotCache中的副本和负缓存
+func (g *Group) invalidate(key string) {
+	g.cache.remove(key)
+	if g.hotCache != nil {
+		g.hotCache.remove(key)
+	}
+	g.forgetNotFound(key)
+}
+
+// forgetNotFound 丢弃key的负缓存 key被写入后就不再是"不存在"了
+func (g *Group) forgetNotFound(key string) {
+	if g.negCache != nil {
+		g.negCache.remove(key)
+	}
+}
+
+// invalidatePeers 并发通知其他所有节点丢弃key的本地副本
+func (g *Group) invalidatePeers(ctx context.Context, key string) error {
+	if g.server == nil {
+		return nil
+	}
+	peers := g.server.Peers()
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer Fetcher) {
+			defer wg.Done()
+			errs[i] = peer.Invalidate(ctx, g.name, key)
+		}(i, peer)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// load 加载key对应的数据 同一时刻同一key只会加载一次
+func (g *Group) load(ctx context.Context, key string) (ByteView, error) {
+	g.stats.loads.Add(1)
+	return g.fly(ctx, key, func(ctx context.Context) (ByteView, error) {
 		if g.server != nil {
 			// getFromPeer 从远端节点获取数据
-			if fetcher, ok := g.server.PickPeer(key); ok {
-				bytes, err := fetcher.Fetch(g.name, key)
+			if fetcher, ok := g.server.PickPeer(ctx, key); ok {
+				res, err := fetcher.Fetch(ctx, g.name, key)
 				if err == nil {
-					return ByteView{b: cloneBytes(bytes)}, nil
+					g.stats.peerLoads.Add(1)
+					value := ByteView{b: cloneBytes(res.Value), version: res.Version}
+					g.populateHotCache(key, value, res)
+					return value, nil
 				}
+				g.stats.peerErrors.Add(1)
 				log.Printf("fail to get *%s* from peer, %s.\n", key, err.Error())
 			}
 		}
-		return g.getLocally(key)
+		return g.getLocally(ctx, key)
 	})
-	if err == nil {
-		return view.(ByteView), err
+}
+
+// loadLocally 跳过远端节点 直接从数据源加载key 同一时刻同一key只会加载一次
+func (g *Group) loadLocally(ctx context.Context, key string) (ByteView, error) {
+	return g.fly(ctx, key, func(ctx context.Context) (ByteView, error) {
+		return g.getLocally(ctx, key)
+	})
+}
+
+// fly 通过singleflight执行fn 同一时刻同一key只会执行一次
+// fn 使用所有调用方共享的ctx(见sharedContext) 超时为loadTimeout
+// 每个调用方只等待到自己的ctx结束为止
+func (g *Group) fly(ctx context.Context, key string, fn func(ctx context.Context) (ByteView, error)) (ByteView, error) {
+	if err := ctx.Err(); err != nil {
+		return ByteView{}, err
+	}
+	shared := g.joinLoad(ctx, key)
+	done := make(chan struct{})
+	var view interface{}
+	var err error
+	go func() {
+		defer close(done)
+		view, err = g.flight.Fly(key, func() (interface{}, error) {
+			defer g.finishLoad(key, shared)
+			g.stats.loadsDeduped.Add(1)
+			var loadCtx context.Context = shared
+			if g.loadTimeout > 0 {
+				var cancel context.CancelFunc
+				loadCtx, cancel = context.WithTimeout(loadCtx, g.loadTimeout)
+				defer cancel()
+			}
+			return fn(loadCtx)
+		})
+	}()
+	select {
+	case <-done:
+		shared.leave(nil)
+	case <-ctx.Done():
+		shared.leave(ctx.Err())
+		return ByteView{}, ctx.Err()
+	}
+	if err != nil {
+		return ByteView{}, err
+	}
+	return view.(ByteView), nil
+}
+
+// joinLoad 作为等待者加入key正在进行的加载的共享ctx 没有时新建一个
+func (g *Group) joinLoad(ctx context.Context, key string) *sharedContext {
+	g.loadingMu.Lock()
+	defer g.loadingMu.Unlock()
+	if g.loading == nil {
+		g.loading = make(map[string]*sharedContext)
+	}
+	if shared, ok := g.loading[key]; ok && shared.join(ctx) {
+		return shared
+	}
+	// 之前的等待者都已离开 旧的共享ctx已被取消
+	shared := newSharedContext(ctx)
+	shared.join(ctx)
+	g.loading[key] = shared
+	return shared
+}
+
+// finishLoad 加载结束后移除key的共享ctx
+func (g *Group) finishLoad(key string, shared *sharedContext) {
+	g.loadingMu.Lock()
+	defer g.loadingMu.Unlock()
+	if g.loading[key] == shared {
+		delete(g.loading, key)
+	}
+}
+
+// fetchMulti 通过一次批量RPC从远端节点获取keys 结果通过set返回
+// 与Get一致 RPC失败时这批key并行从数据源加载 单个key失败(不存在除外)时该key从数据源加载
+// 加载仍失败时返回stale-if-error窗口内的旧值
+func (g *Group) fetchMulti(ctx context.Context, peer Fetcher, keys []string, set func(key string, value ByteView, err error)) {
+	g.stats.loads.Add(int64(len(keys)))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	loadLocally := func(key string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := g.loadLocally(ctx, key)
+			value, err = g.orStale(ctx, key, value, err)
+			set(key, value, err)
+		}()
+	}
+	results, err := peer.FetchMulti(ctx, g.name, keys)
+	if err != nil {
+		g.stats.peerErrors.Add(int64(len(keys)))
+		log.Printf("fail to get %d keys from peer, %s.\n", len(keys), err.Error())
+		for _, key := range keys {
+			loadLocally(key)
+		}
+		return
+	}
+	g.stats.loadsDeduped.Add(int64(len(keys)))
+	for i, key := range keys {
+		res := results[i]
+		if res.Err != nil {
+			g.stats.peerErrors.Add(1)
+			// 所属节点确认key不存在时 没必要再问数据源
+			if errors.Is(res.Err, ErrNotFound) {
+				set(key, ByteView{}, res.Err)
+				continue
+			}
+			log.Printf("fail to get *%s* from peer, %s.\n", key, res.Err.Error())
+			loadLocally(key)
+			continue
+		}
+		g.stats.peerLoads.Add(1)
+		value := ByteView{b: cloneBytes(res.Value), version: res.Version}
+		g.populateHotCache(key, value, res.Result)
+		set(key, value, nil)
 	}
-	return ByteView{}, err
 }
 
-// getLocally 本地向Retriever取回数据并填充缓存
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.retriever.retrieve(key)
+// populateHotCache 以采样的方式将远端取回的值写入hotCache
+// 只有被频繁访问的key才大概率留在hotCache中 res是所属节点对缓存的要求
+// 副本在所属节点给出的过期时间和hotTTL中较早的一个过期
+func (g *Group) populateHotCache(key string, value ByteView, res Result) {
+	if g.hotCache == nil || res.NoStore || rand.Float64() >= g.hotSampleRate {
+		return
+	}
+	now := g.clock.Now()
+	expire := res.Expire
+	if g.hotTTL > 0 && (expire.IsZero() || now.Add(g.hotTTL).Before(expire)) {
+		expire = now.Add(g.hotTTL)
+	}
+	if cachestrategy.Expired(expire, now) {
+		return
+	}
+	g.hotCache.add(key, value, expire)
+}
+
+// getLocally 本地向数据源取回数据 并按数据源的要求填充缓存
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	start := time.Now()
+	res, err := g.retriever.Get(ctx, key)
 	if err != nil {
+		g.stats.localLoadErrs.Add(1)
+		if g.negCache != nil && g.negClassifier(err) {
+			g.negCache.add(key, ByteView{b: []byte(err.Error())}, g.clock.Now().Add(g.negTTL))
+		}
 		return ByteView{}, err
 	}
-	value := ByteView{b: cloneBytes(bytes)}
-	g.cache.add(key, value) // 将数据添加到缓存中
-	return value, nil
+	value := ByteView{b: cloneBytes(res.Value), version: res.Version, delta: time.Since(start)}
+	g.stats.localLoads.Add(1)
+	if res.NoStore {
+		value.noStore = true
+		return value, nil
+	}
+	expire := res.Expire
+	if expire.IsZero() {
+		expire = g.expireAt()
+	} else if cachestrategy.Expired(expire, g.clock.Now()) {
+		// 数据源给出的过期时间已过 没有缓存的必要
+		value.noStore = true
+		return value, nil
+	}
+	// 将数据添加到缓存中 返回的值带有过期时间 作为所属节点时会转告给其他节点
+	return g.populateCache(key, value, expire), nil
+}
+
+// populateCache 写入cache 共享内存上限被超出时由MemoryManager回收
+// 返回记录了变旧和过期时间的value
+func (g *Group) populateCache(key string, value ByteView, expire time.Time) ByteView {
+	value, expire = g.stamp(value, expire)
+	g.cache.add(key, value, expire)
+	if g.memory != nil {
+		g.memory.reclaim()
+	}
+	return value
+}
+
+// stamp 在value上记录变旧和过期的时间 返回cache中实际使用的过期时间
+// 过期的值还要在stale-if-error窗口内保留 以便加载失败时返回
+func (g *Group) stamp(value ByteView, expire time.Time) (ByteView, time.Time) {
+	value.expire = expire
+	if g.softTTL > 0 {
+		value.stale = g.clock.Now().Add(g.softTTL)
+		if !expire.IsZero() && expire.Before(value.stale) {
+			value.stale = expire
+		}
+	}
+	if g.staleIfError > 0 && !expire.IsZero() {
+		expire = expire.Add(g.staleIfError)
+	}
+	return value, expire
+}
+
+// expireAt 根据默认过期时长计算过期时间 零值表示永不过期
+func (g *Group) expireAt() time.Time {
+	if g.ttl <= 0 {
+		return time.Time{}
+	}
+	ttl := g.ttl
+	if jitter := g.expiryJitter; jitter > 0 {
+		if jitter > ttl {
+			jitter = ttl
+		}
+		ttl -= time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return g.clock.Now().Add(ttl)
 }
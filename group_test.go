@@ -1,21 +1,39 @@
 package simplegroupcache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	cachestrategy "simple-groupcache/cache-strategy"
+	"simple-groupcache/cache-strategy/lfu"
+	"simple-groupcache/cache-strategy/lru"
 )
 
 func TestGet(t *testing.T) {
+	for _, cacheStrategy := range []string{"lru", "lfu", "arc", "tinylfu"} {
+		testGet(t, cacheStrategy)
+	}
+}
+
+func testGet(t *testing.T, cacheStrategy string) {
 	db := map[string]string{
 		"Tom":  "630",
 		"Jack": "589",
 		"Sam":  "567",
 	}
-	cacheStrategy := "lru"
 	loadCounts := make(map[string]int, len(db))
 
-	g := NewGroup("scores", 2<<10, cacheStrategy, RetrieverFunc(
+	g, err := NewGroup("scores", 2<<10, cacheStrategy, RetrieverFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[Mysql] search key", key)
 			if v, ok := db[key]; ok {
@@ -27,19 +45,993 @@ func TestGet(t *testing.T) {
 			}
 			return nil, fmt.Errorf("%s not exist", key)
 		}))
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for k, v := range db {
-		if view, err := g.Get(k); err != nil || view.String() != v {
+		if view, err := g.Get(context.Background(), k); err != nil || view.String() != v {
 			t.Fatalf("failed to get value of %s", k)
 		}
-		if _, err := g.Get(k); err != nil || loadCounts[k] > 1 {
+		if _, err := g.Get(context.Background(), k); err != nil || loadCounts[k] > 1 {
 			t.Fatalf("cache %s miss", k)
 		}
 	}
 
-	if view, err := g.Get("unknown"); err == nil {
+	if view, err := g.Get(context.Background(), "unknown"); err == nil {
 		t.Fatalf("the value of unknow should be empty, but %s got", view)
 	} else {
 		log.Println(err)
 	}
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestGetExpired(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	loadCounts := 0
+	g, err := NewGroup("ttl", 2<<10, "lfu", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			loadCounts++
+			return []byte(key), nil
+		}), WithTTL(time.Second), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Get(context.Background(), "Tom"); err != nil || loadCounts != 1 {
+			t.Fatalf("expected 1 load before expiry, got %d", loadCounts)
+		}
+	}
+	clock.now = clock.now.Add(time.Second)
+	if _, err := g.Get(context.Background(), "Tom"); err != nil || loadCounts != 2 {
+		t.Fatalf("expected reload after expiry, got %d loads", loadCounts)
+	}
+}
+
+func TestReapDisabled(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		loadCounts := 0
+		g, err := NewGroup("reap", 2<<10, "lru", RetrieverFunc(
+			func(key string) ([]byte, error) {
+				loadCounts++
+				return []byte(key), nil
+			}), WithTTL(time.Second), WithClock(clock), WithReapInterval(interval))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 关闭后台清理时 写入带过期时间的缓存不会启动清理协程 过期缓存仍会惰性删除
+		g.Get(context.Background(), "Tom")
+		time.Sleep(10 * time.Millisecond)
+		clock.now = clock.now.Add(time.Second)
+		if _, err := g.Get(context.Background(), "Tom"); err != nil || loadCounts != 2 {
+			t.Fatalf("expected reload after expiry, got %d loads", loadCounts)
+		}
+		DestroyGroup("reap")
+	}
+}
+
+func TestGetterResult(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	loadCounts := make(map[string]int)
+	g, err := NewGroup("result", 2<<10, "lru", GetterFunc(
+		func(_ context.Context, key string) (Result, error) {
+			loadCounts[key]++
+			switch key {
+			case "volatile":
+				return Result{Value: []byte(key), NoStore: true}, nil
+			case "short":
+				return Result{Value: []byte(key), Expire: clock.now.Add(time.Second)}, nil
+			}
+			return Result{Value: []byte(key), Version: 17}, nil
+		}), WithTTL(time.Hour), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Get(context.Background(), "volatile"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loadCounts["volatile"] != 2 {
+		t.Fatalf("NoStore result should not be cached, loaded %d times", loadCounts["volatile"])
+	}
+
+	if view, err := g.Get(context.Background(), "versioned"); err != nil || view.Version() != 17 {
+		t.Fatalf("expected version 17, got %d", view.Version())
+	}
+
+	g.Get(context.Background(), "short")
+	clock.now = clock.now.Add(time.Second)
+	g.Get(context.Background(), "short")
+	if loadCounts["short"] != 2 {
+		t.Fatalf("result expire should override default ttl, loaded %d times", loadCounts["short"])
+	}
+}
+
+type ctxKey struct{}
+
+func TestGetContext(t *testing.T) {
+	g, err := NewGroup("context", 2<<10, "lru", GetterFunc(
+		func(ctx context.Context, key string) (Result, error) {
+			if err := ctx.Err(); err != nil {
+				return Result{}, err
+			}
+			return Result{Value: []byte(ctx.Value(ctxKey{}).(string))}, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "from ctx")
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "from ctx" {
+		t.Fatalf("ctx should reach the getter, got %q, %v", view.String(), err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := g.Get(ctx, "Jack"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestGetSharedLoad(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	deadlines := make(chan time.Time, 2)
+	g, err := NewGroup("shared-load", 2<<10, "lru", GetterFunc(
+		func(ctx context.Context, key string) (Result, error) {
+			deadline, _ := ctx.Deadline()
+			deadlines <- deadline
+			started <- struct{}{}
+			<-release
+			if err := ctx.Err(); err != nil {
+				return Result{}, err
+			}
+			return Result{Value: []byte("630")}, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一个调用方超时 只影响它自己 共享的加载和其他调用方不受影响
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	expect, _ := ctx.Deadline()
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.Get(ctx, "Tom")
+		first <- err
+	}()
+	<-started
+	// 调用方的deadline传递给了数据源
+	if deadline := <-deadlines; !deadline.Equal(expect) {
+		t.Fatalf("caller's deadline should reach the getter, got %v", deadline)
+	}
+	second := make(chan string, 1)
+	go func() {
+		view, _ := g.Get(context.Background(), "Tom")
+		second <- view.String()
+	}()
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	close(release)
+	if v := <-second; v != "630" {
+		t.Fatalf("other callers should get the value, got %q", v)
+	}
+
+	// 所有调用方都离开后 共享的加载被取消
+	canceled := make(chan error, 1)
+	g, err = NewGroup("shared-load", 2<<10, "lru", GetterFunc(
+		func(ctx context.Context, key string) (Result, error) {
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return Result{}, ctx.Err()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	g.Get(ctx, "Tom")
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("shared load should be canceled after all callers left")
+	}
+
+	var hasDeadline atomic.Bool
+	g, err = NewGroup("shared-load", 2<<10, "lru", GetterFunc(
+		func(ctx context.Context, key string) (Result, error) {
+			_, ok := ctx.Deadline()
+			hasDeadline.Store(ok)
+			return Result{Value: []byte("630")}, nil
+		}), WithLoadTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(context.Background(), "Tom"); err != nil || !hasDeadline.Load() {
+		t.Fatalf("load timeout should be applied, got %v", err)
+	}
+}
+
+// fakePeer 记录远端节点收到的请求
+type fakePeer struct {
+	store       map[string][]byte
+	invalidated []string
+	fetches     int
+	batches     int             // 收到的批量请求数
+	down        bool            // 为true时批量请求失败
+	broken      map[string]bool // 批量请求中这些key返回"不存在"以外的错误
+	meta        Result          // 返回值附带的缓存要求
+}
+
+func (p *fakePeer) Fetch(_ context.Context, _ string, key string) (Result, error) {
+	p.fetches++
+	if v, ok := p.store[key]; ok {
+		res := p.meta
+		res.Value = v
+		return res, nil
+	}
+	return Result{}, fmt.Errorf("%s not exist", key)
+}
+
+func (p *fakePeer) FetchMulti(ctx context.Context, group string, keys []string) ([]FetchResult, error) {
+	p.batches++
+	if p.down {
+		return nil, fmt.Errorf("peer is down")
+	}
+	results := make([]FetchResult, len(keys))
+	for i, key := range keys {
+		if p.broken[key] {
+			results[i].Err = fmt.Errorf("%s: peer internal error", key)
+		} else if v, ok := p.store[key]; ok {
+			results[i].Result = p.meta
+			results[i].Value = v
+		} else {
+			results[i].Err = fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+	}
+	return results, nil
+}
+
+func (p *fakePeer) Set(_ context.Context, _ string, key string, value []byte) error {
+	p.store[key] = value
+	return nil
+}
+
+func (p *fakePeer) Remove(_ context.Context, _ string, key string) error {
+	delete(p.store, key)
+	return nil
+}
+
+func (p *fakePeer) Invalidate(_ context.Context, _ string, key string) error {
+	p.invalidated = append(p.invalidated, key)
+	return nil
+}
+
+// fakePicker 将remote开头的key分配给远端节点 其余key归属本节点
+type fakePicker struct {
+	peer *fakePeer
+}
+
+func (p *fakePicker) PickPeer(_ context.Context, key string) (Fetcher, bool) {
+	if strings.HasPrefix(key, "remote") {
+		return p.peer, true
+	}
+	return nil, false
+}
+
+func (p *fakePicker) Peers() []Fetcher {
+	return []Fetcher{p.peer}
+}
+
+func TestGetMulti(t *testing.T) {
+	ctx := context.Background()
+	loadCounts := make(map[string]int)
+	var mu sync.Mutex
+	g, err := NewGroup("multi", 2<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			loadCounts[key]++
+			return []byte("db-" + key), nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &fakePeer{store: map[string][]byte{"remote-Tom": []byte("630")}}
+	g.RegisterSvr(&fakePicker{peer: peer})
+	g.Get(ctx, "Tom")
+
+	keys := []string{"Tom", "Jack", "Jack", "remote-Tom", "remote-Jack", ""}
+	results := g.GetMulti(ctx, keys)
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	for key, expect := range map[string]string{"Tom": "db-Tom", "Jack": "db-Jack", "remote-Tom": "630"} {
+		if res := results[key]; res.Err != nil || res.Value.String() != expect {
+			t.Fatalf("%s: expected %s, got %s %v", key, expect, res.Value, res.Err)
+		}
+	}
+	if !errors.Is(results["remote-Jack"].Err, ErrNotFound) || results[""].Err == nil {
+		t.Fatalf("expected errors of remote-Jack and empty key, got %+v", results)
+	}
+	// 远端的key只发送一次批量请求 本地命中的key不再加载
+	if peer.batches != 1 || peer.fetches != 0 || loadCounts["Tom"] != 1 || loadCounts["Jack"] != 1 {
+		t.Fatalf("unexpected loads, batches %d fetches %d loads %v", peer.batches, peer.fetches, loadCounts)
+	}
+
+	// 批量请求失败时从本节点的数据源加载
+	peer.down = true
+	results = g.GetMulti(ctx, []string{"remote-Sam"})
+	if res := results["remote-Sam"]; res.Err != nil || res.Value.String() != "db-remote-Sam" {
+		t.Fatalf("expected fallback to local load, got %s %v", res.Value, res.Err)
+	}
+	// 单个key失败时该key从本节点的数据源加载 "不存在"则直接返回
+	peer.down = false
+	peer.broken = map[string]bool{"remote-Ann": true}
+	results = g.GetMulti(ctx, []string{"remote-Ann", "remote-Bob"})
+	if res := results["remote-Ann"]; res.Err != nil || res.Value.String() != "db-remote-Ann" {
+		t.Fatalf("expected fallback to local load for a failed key, got %s %v", res.Value, res.Err)
+	}
+	if !errors.Is(results["remote-Bob"].Err, ErrNotFound) || loadCounts["remote-Bob"] != 0 {
+		t.Fatalf("not found key should not be loaded locally, got %v", results["remote-Bob"].Err)
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	ctx := context.Background()
+	loadCounts := make(map[string]int)
+	g, err := NewGroup("set", 2<<10, "arc", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			loadCounts[key]++
+			return []byte("db"), nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &fakePeer{store: make(map[string][]byte)}
+	g.RegisterSvr(&fakePicker{peer: peer})
+
+	// 本节点是所属节点: 写入本地并广播失效
+	if err := g.Set(ctx, "Tom", []byte("630")); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "630" || loadCounts["Tom"] != 0 {
+		t.Fatalf("Set value should be served from cache, got %s", view.String())
+	}
+	if err := g.Remove(ctx, "Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "db" || loadCounts["Tom"] != 1 {
+		t.Fatalf("removed key should be reloaded, got %s", view.String())
+	}
+	if !reflect.DeepEqual(peer.invalidated, []string{"Tom", "Tom"}) {
+		t.Fatalf("owner should broadcast invalidation, got %v", peer.invalidated)
+	}
+
+	// 远端节点是所属节点: 写操作被路由过去
+	if err := g.Set(ctx, "remote-Jack", []byte("589")); err != nil {
+		t.Fatal(err)
+	}
+	if string(peer.store["remote-Jack"]) != "589" {
+		t.Fatalf("Set should be routed to the owner")
+	}
+	if err := g.Remove(ctx, "remote-Jack"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := peer.store["remote-Jack"]; ok {
+		t.Fatalf("Remove should be routed to the owner")
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		hotCacheBytes int64
+		fetches       int
+	}{{1 << 10, 1}, {0, 2}} {
+		g, err := NewGroup("hot", 2<<10, "lru", RetrieverFunc(
+			func(key string) ([]byte, error) {
+				return nil, fmt.Errorf("%s not exist", key)
+			}), WithHotCache(c.hotCacheBytes, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := &fakePeer{store: map[string][]byte{"remote-Tom": []byte("630")}}
+		g.RegisterSvr(&fakePicker{peer: peer})
+
+		for i := 0; i < 2; i++ {
+			if view, err := g.Get(ctx, "remote-Tom"); err != nil || view.String() != "630" {
+				t.Fatalf("failed to get remote-Tom from peer")
+			}
+		}
+		if peer.fetches != c.fetches {
+			t.Fatalf("hot cache %d bytes: expected %d fetches, got %d", c.hotCacheBytes, c.fetches, peer.fetches)
+		}
+	}
+}
+
+func TestHotCacheMeta(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		name    string
+		meta    Result
+		hotTTL  time.Duration
+		fetches int // 时钟前进2秒后共发起的远端请求数
+	}{
+		{"no store", Result{NoStore: true}, time.Minute, 3},
+		{"owner expire", Result{Expire: time.Unix(1, 0)}, time.Minute, 2},
+		{"hot ttl", Result{}, time.Second, 2},
+		{"never expire", Result{}, 0, 1},
+	} {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		g, err := NewGroup("hot-meta", 2<<10, "lru", RetrieverFunc(
+			func(key string) ([]byte, error) {
+				return nil, fmt.Errorf("%s not exist", key)
+			}), WithHotCache(1<<10, 1), WithHotCacheTTL(c.hotTTL), WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := &fakePeer{store: map[string][]byte{"remote-Tom": []byte("630")}, meta: c.meta}
+		g.RegisterSvr(&fakePicker{peer: peer})
+
+		for i := 0; i < 3; i++ {
+			if i == 2 {
+				clock.now = clock.now.Add(2 * time.Second)
+			}
+			if view, err := g.Get(ctx, "remote-Tom"); err != nil || view.String() != "630" {
+				t.Fatalf("%s: failed to get remote-Tom from peer", c.name)
+			}
+		}
+		if peer.fetches != c.fetches {
+			t.Fatalf("%s: expected %d fetches, got %d", c.name, c.fetches, peer.fetches)
+		}
+		DestroyGroup(g.name)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	g, err := NewGroup("stats", 12, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			if key == "Unknown" {
+				return nil, fmt.Errorf("%s not exist", key)
+			}
+			return []byte("123"), nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Get(ctx, "Tom")
+	g.Get(ctx, "Tom")
+	g.Get(ctx, "Jack") // Tom被淘汰
+	g.Get(ctx, "Unknown")
+
+	stats := g.Stats()
+	if stats.Gets != 4 || stats.CacheHits != 1 || stats.Loads != 3 || stats.LoadsDeduped != 3 {
+		t.Fatalf("unexpected get stats: %+v", stats)
+	}
+	if stats.LocalLoads != 2 || stats.LocalLoadErrs != 1 || stats.PeerLoads != 0 {
+		t.Fatalf("unexpected load stats: %+v", stats)
+	}
+	expect := CacheStats{
+		Bytes:         int64(len("Jack123")),
+		ResidentBytes: int64(len("Jack123")) + lru.EntryOverhead,
+		Items:         1,
+		Evictions:     1,
+	}
+	if stats.MainCache != expect {
+		t.Fatalf("expected main cache stats %+v, got %+v", expect, stats.MainCache)
+	}
+}
+
+func TestCacheStrategy(t *testing.T) {
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+	if _, err := NewGroup("strategy", 2<<10, "lur", retriever); err == nil {
+		t.Fatalf("unknown cache strategy should fail")
+	}
+
+	// 注册表是全局的 go test -count=N时本测试会多次运行 只注册一次
+	if _, ok := cachestrategy.Lookup("test-lru"); !ok {
+		cachestrategy.Register("test-lru", func(maxBytes int64, callback cachestrategy.OnEvicted) cachestrategy.CacheStrategy {
+			return lru.New(maxBytes, callback)
+		})
+	}
+	if _, err := NewGroup("strategy", 2<<10, "test-lru", retriever); err != nil {
+		t.Fatal(err)
+	}
+
+	custom := lfu.New(2<<10, nil)
+	g, err := NewGroup("strategy", 2<<10, "", retriever, WithStrategy(custom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(context.Background(), "Tom"); err != nil || !custom.Contains("Tom") {
+		t.Fatalf("constructed strategy should be used as the cache")
+	}
+}
+
+func TestShards(t *testing.T) {
+	g, err := NewGroup("shards", 2<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), WithShards(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.cache.shards) != 4 {
+		t.Fatalf("expected 4 shards, got %d", len(g.cache.shards))
+	}
+	var capacity int64
+	for _, s := range g.cache.shards {
+		capacity += s.cache.(*lru.Cache).MaxByte
+	}
+	if capacity != 2<<10 {
+		t.Fatalf("shards should share the byte budget, got %d", capacity)
+	}
+	for i := 0; i < 100; i++ {
+		g.Get(context.Background(), strconv.Itoa(i))
+	}
+	if stats := g.Stats(); stats.MainCache.Items != 100 || stats.LoadsDeduped != 100 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCapacityLimits(t *testing.T) {
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+	g, err := NewGroup("entries", 2<<10, "lru", retriever, WithMaxEntries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		g.Get(context.Background(), strconv.Itoa(i))
+	}
+	if stats := g.Stats().MainCache; stats.Items != 3 || stats.Evictions != 7 {
+		t.Fatalf("max entries should be enforced, got %+v", stats)
+	}
+
+	// 每条缓存计入结构开销后 2KB只能放下很少的小缓存
+	g, err = NewGroup("overhead", 2<<10, "lru", retriever, WithChargeOverhead(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		g.Get(context.Background(), strconv.Itoa(i))
+	}
+	stats := g.Stats().MainCache
+	if stats.ResidentBytes > 2<<10 || stats.Items != (2<<10)/(lru.EntryOverhead+4) {
+		t.Fatalf("resident bytes should be bounded by maxBytes, got %+v", stats)
+	}
+	if stats.ResidentBytes != stats.Bytes+stats.Items*lru.EntryOverhead {
+		t.Fatalf("unexpected resident bytes %+v", stats)
+	}
+}
+
+func TestAging(t *testing.T) {
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+	if _, err := NewGroup("aging", 2<<10, "lru", retriever, WithAging(100, 0)); err == nil {
+		t.Fatalf("lru does not support aging")
+	}
+	g, err := NewGroup("aging", 2<<10, "lfu", retriever, WithAging(100, time.Minute), WithShards(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get(context.Background(), "Tom"); err != nil || view.String() != "Tom" {
+		t.Fatalf("failed to get Tom with aging enabled")
+	}
+}
+
+func TestSetCacheBytes(t *testing.T) {
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	for _, cacheStrategy := range []string{"lru", "lfu", "arc", "tinylfu"} {
+		g, err := NewGroup("resize", 2<<10, cacheStrategy, retriever, WithShards(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			g.Get(context.Background(), strconv.Itoa(i))
+		}
+		g.SetCacheBytes(240)
+		if stats := g.Stats().MainCache; g.CacheBytes() != 240 || stats.Bytes > 240 || stats.Evictions == 0 {
+			t.Fatalf("%s: shrinking should evict immediately, got %+v", cacheStrategy, stats)
+		}
+		g.SetCacheBytes(2 << 10)
+		for i := 0; i < 100; i++ {
+			g.Get(context.Background(), strconv.Itoa(i))
+		}
+		if stats := g.Stats().MainCache; stats.Bytes <= 240 {
+			t.Fatalf("%s: growing should allow more entries, got %+v", cacheStrategy, stats)
+		}
+	}
+}
+
+func TestPeekKeys(t *testing.T) {
+	g, err := NewGroup("peek", 2<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Peek("Tom"); ok {
+		t.Fatalf("peek should not load Tom")
+	}
+	g.Get(context.Background(), "Tom")
+	g.Get(context.Background(), "Jack")
+	if view, ok := g.Peek("Tom"); !ok || view.String() != "Tom" {
+		t.Fatalf("failed to peek Tom")
+	}
+	if keys := g.Keys(); !reflect.DeepEqual(keys, []string{"Tom", "Jack"}) {
+		t.Fatalf("expected keys in eviction order, got %v", keys)
+	}
+	if stats := g.Stats(); stats.Gets != 2 || stats.CacheHits != 0 {
+		t.Fatalf("peek should not be counted, got %+v", stats)
+	}
+}
+
+func TestEvictionListener(t *testing.T) {
+	var g *Group
+	reasons := make(map[string]EvictReason)
+	listener := func(key string, value ByteView, reason EvictReason) {
+		// 监听者在锁外调用 可以再访问Group
+		g.Peek(key)
+		reasons[key+"="+value.String()] = reason
+	}
+	db := map[string]string{
+		"Tom":  "630",
+		"Jack": "589",
+		"Sam":  "567",
+	}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	g, err := NewGroup("listener", 12, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithEvictionListener(listener), WithTTL(time.Minute), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	g.Get(ctx, "Tom")
+	g.Set(ctx, "Tom", []byte("100"))
+	g.Get(ctx, "Jack") // Tom被淘汰
+	g.Remove(ctx, "Jack")
+	g.Get(ctx, "Sam")
+	clock.now = clock.now.Add(time.Minute)
+	g.Get(ctx, "Sam") // Sam已过期
+
+	expect := map[string]EvictReason{
+		"Tom=630":  EvictReplaced,
+		"Jack=589": EvictRemoved,
+		"Tom=100":  EvictCapacity,
+		"Sam=567":  EvictExpired,
+	}
+	if !reflect.DeepEqual(reasons, expect) {
+		t.Fatalf("expected %v, got %v", expect, reasons)
+	}
+}
+
+func TestEvictionListenerOnShrink(t *testing.T) {
+	var g *Group
+	var evicted []string
+	listener := func(key string, value ByteView, reason EvictReason) {
+		// 缩容时监听者可以读取容量并再次加载数据 而不会死锁
+		g.CacheBytes()
+		if len(evicted) == 0 {
+			g.Get(context.Background(), "Sam")
+		}
+		evicted = append(evicted, key)
+	}
+	g, err := NewGroup("listener-shrink", 1<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte("0123456789"), nil
+		}), WithEvictionListener(listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Get(context.Background(), "Tom")
+	g.Get(context.Background(), "Jack")
+
+	done := make(chan struct{})
+	go func() {
+		g.SetCacheBytes(20)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("listener deadlocked during shrink")
+	}
+	if len(evicted) == 0 || g.CacheBytes() != 20 {
+		t.Fatalf("shrink should evict entries, got %v", evicted)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	loads := 0
+	g, err := NewGroup("negative", 2<<10, "lru", GetterFunc(
+		func(_ context.Context, key string) (Result, error) {
+			loads++
+			if key == "Unknown" {
+				return Result{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+			}
+			return Result{}, fmt.Errorf("db is down")
+		}), WithNegativeCache(time.Minute, 1<<10, nil), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get(ctx, "Unknown"); !errors.Is(err, ErrNotFound) || err.Error() != "Unknown: not found" {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("not found should be cached, got %d loads", loads)
+	}
+	// 其他错误不会被缓存
+	g.Get(ctx, "Tom")
+	g.Get(ctx, "Tom")
+	if loads != 3 {
+		t.Fatalf("other errors should not be cached, got %d loads", loads)
+	}
+	stats := g.Stats()
+	if stats.NegativeHits != 2 || stats.NegativeCache.Items != 1 || stats.MainCache.Items != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	g.Get(ctx, "Unknown")
+	if loads != 4 {
+		t.Fatalf("negative entry should expire, got %d loads", loads)
+	}
+	// 写入后key不再是不存在
+	g.Set(ctx, "Unknown", []byte("1"))
+	if view, err := g.Get(ctx, "Unknown"); err != nil || view.String() != "1" {
+		t.Fatalf("set should clear the negative entry, got %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	ctx := context.Background()
+	loads := 0
+	g, err := NewGroup("bloom", 2<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}), WithBloomFilter(100, 0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 过滤器为空 所有key都被拒绝 不会调用数据源
+	if _, err := g.Get(ctx, "Tom"); !errors.Is(err, ErrNotFound) || loads != 0 {
+		t.Fatalf("unknown key should be rejected, got %v", err)
+	}
+	g.AddKeys("Tom")
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "Tom" || loads != 1 {
+		t.Fatalf("added key should pass, got %v", err)
+	}
+	if stats := g.Stats(); stats.BloomRejects != 1 {
+		t.Fatalf("expected 1 bloom reject, got %d", stats.BloomRejects)
+	}
+
+	// 重建失败时保留旧的过滤器
+	err = g.RebuildBloomFilter(func(yield func(key string) bool) error {
+		yield("Jack")
+		return fmt.Errorf("db is down")
+	})
+	if err == nil {
+		t.Fatalf("rebuild should fail")
+	}
+	if _, err := g.Get(ctx, "Jack"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("failed rebuild should keep the old filter, got %v", err)
+	}
+
+	err = g.RebuildBloomFilter(func(yield func(key string) bool) error {
+		for _, key := range []string{"Jack", "Sam"} {
+			if !yield(key) {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(ctx, "Sam"); err != nil {
+		t.Fatalf("rebuilt filter should contain Sam, got %v", err)
+	}
+	g.cache.remove("Tom")
+	if _, err := g.Get(ctx, "Tom"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("rebuilt filter should replace the old one, got %v", err)
+	}
+}
+
+func TestStaleValues(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	gate := make(chan struct{}, 1) // 每次加载前需要放入一个令牌
+	var loads atomic.Int64
+	var fail atomic.Bool
+	g, err := NewGroup("stale", 2<<10, "lru", GetterFunc(
+		func(_ context.Context, key string) (Result, error) {
+			<-gate
+			n := loads.Add(1)
+			if fail.Load() {
+				return Result{}, fmt.Errorf("db is down")
+			}
+			return Result{Value: []byte(fmt.Sprintf("v%d", n))}, nil
+		}), WithClock(clock), WithTTL(2*time.Minute),
+		WithStaleWhileRevalidate(time.Minute), WithStaleIfError(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gate <- struct{}{}
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "v1" {
+		t.Fatalf("failed to get Tom, %v", err)
+	}
+	// 变旧后立即返回旧值 只触发一次后台刷新
+	clock.now = clock.now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "v1" {
+			t.Fatalf("stale value should be served, got %s %v", view, err)
+		}
+	}
+	gate <- struct{}{}
+	for deadline := time.Now().Add(time.Second); ; {
+		if view, _ := g.Peek("Tom"); view.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale value was not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := g.Stats(); loads.Load() != 2 || stats.StaleHits != 3 {
+		t.Fatalf("expected 1 refresh for 3 stale hits, got %d loads %+v", loads.Load(), stats)
+	}
+
+	// 过期后加载失败 在stale-if-error窗口内返回旧值
+	fail.Store(true)
+	clock.now = clock.now.Add(2*time.Minute + 30*time.Second)
+	// 过期的旧值只在加载失败时使用 Peek和Keys看不到它
+	if _, ok := g.Peek("Tom"); ok || len(g.Keys()) != 0 {
+		t.Fatalf("expired value should be hidden from Peek and Keys")
+	}
+	gate <- struct{}{}
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "v2" {
+		t.Fatalf("stale value should be served on error, got %s %v", view, err)
+	}
+	if stats := g.Stats(); stats.StaleIfErrors != 1 {
+		t.Fatalf("expected 1 stale-if-error, got %d", stats.StaleIfErrors)
+	}
+	clock.now = clock.now.Add(30 * time.Second)
+	gate <- struct{}{}
+	if _, err := g.Get(ctx, "Tom"); err == nil {
+		t.Fatalf("stale value should be dropped after the window")
+	}
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	var loads atomic.Int64
+	g, err := NewGroup("early", 2<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			time.Sleep(time.Millisecond)
+			return []byte(fmt.Sprintf("v%d", loads.Add(1))), nil
+		}), WithClock(clock), WithTTL(time.Hour), WithEarlyRefresh(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Get(ctx, "Tom")
+	// 离过期还很远 不会提前刷新
+	for i := 0; i < 100; i++ {
+		g.Get(ctx, "Tom")
+	}
+	if stats := g.Stats(); stats.EarlyRefreshes != 0 || loads.Load() != 1 {
+		t.Fatalf("should not refresh far from expiry, got %+v", stats)
+	}
+	// 即将过期时提前在后台刷新 调用方拿到的仍是缓存的值
+	clock.now = clock.now.Add(time.Hour - time.Microsecond)
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "v1" {
+		t.Fatalf("cached value should be served, got %s %v", view, err)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if view, _ := g.Peek("Tom"); view.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("value was not refreshed early")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := g.Stats(); stats.EarlyRefreshes != 1 {
+		t.Fatalf("expected 1 early refresh, got %d", stats.EarlyRefreshes)
+	}
+}
+
+func TestExpiryJitter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	g, err := NewGroup("jitter", 2<<10, "lru", RetrieverFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), WithClock(clock), WithTTL(time.Minute), WithExpiryJitter(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		expire := g.expireAt()
+		if d := expire.Sub(clock.now); d <= 50*time.Second || d > time.Minute {
+			t.Fatalf("expire %v out of range", d)
+		}
+		seen[expire] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expire times should be spread out")
+	}
+}
+
+// BenchmarkGetParallel 比较不同分片数下并发Get的吞吐
+// go test -bench GetParallel -cpu 1,4,16
+func BenchmarkGetParallel(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	for _, shards := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			g, err := NewGroup("bench", 1<<20, "lru", RetrieverFunc(
+				func(key string) ([]byte, error) {
+					return []byte(key), nil
+				}), WithShards(shards))
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+			for _, key := range keys {
+				g.Get(ctx, key)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					g.Get(ctx, keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
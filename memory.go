@@ -0,0 +1,230 @@
+package simplegroupcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memory 模块提供多个 Group 共享的内存上限
+// 每个 Group 的maxBytes是它自己的上限 MemoryManager 在此之上再限制所有 Group 的总和
+// 只管理各 Group 的cache hotCache仍由各自的容量限制
+
+// rebalanceFloor 计算份额时给命中率加上的底数
+// 即使命中率为0 也保留一部分份额 这样新建的 Group 才有机会预热
+const rebalanceFloor = 0.1
+
+// MemoryManager 管理多个 Group 共享的内存上限
+// 所有 Group 的cache占用之和超过limit时 立即从单位字节价值最低的 Group 淘汰
+// 并定期按权重和近期命中率重新分配各 Group 的容量
+// 调整容量和淘汰都在mu之外进行 这样移出监听者可以再访问被管理的 Group
+type MemoryManager struct {
+	limit    int64         // 所有Group共享的字节数上限
+	interval time.Duration // 重新分配容量的间隔 0表示只在Rebalance被调用时分配
+
+	mu         sync.RWMutex
+	members    map[*Group]*member
+	reclaiming atomic.Bool // 同一时刻只有一个reclaim在淘汰 其余直接返回
+
+	startOnce sync.Once
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// member 是 MemoryManager 对一个 Group 的记录
+type member struct {
+	weight   float64 // 配置的权重
+	maxBytes int64   // Group自己的容量上限 0表示只受limit限制 随SetCacheBytes更新
+	lastGets int64   // 上次重新分配时的Get次数 用于计算近期命中率
+	lastHits int64   // 上次重新分配时的命中次数
+	hitRate  float64 // 近期命中率
+}
+
+// score 返回 Group 的价值 权重越高 命中率越高 价值越高
+func (mb *member) score() float64 {
+	return mb.weight * (mb.hitRate + rebalanceFloor)
+}
+
+// NewMemoryManager 创建共享limit字节的 MemoryManager
+// interval 为重新分配容量的间隔 为0时只在调用Rebalance时重新分配
+func NewMemoryManager(limit int64, interval time.Duration) *MemoryManager {
+	return &MemoryManager{
+		limit:    limit,
+		interval: interval,
+		members:  make(map[*Group]*member),
+		stop:     make(chan struct{}),
+	}
+}
+
+// WithMemoryManager 将 Group 的cache交给 MemoryManager 管理 weight为该 Group 的权重
+// 被管理的 Group 的容量会被 MemoryManager 调整 但不会超过NewGroup的maxBytes
+// 之后调用SetCacheBytes修改的是这个上限 实际容量仍由 MemoryManager 分配
+func WithMemoryManager(m *MemoryManager, weight float64) GroupOption {
+	return func(g *Group) {
+		g.memory = m
+		g.memoryWeight = weight
+	}
+}
+
+// register 开始管理 Group 并重新分配容量
+func (m *MemoryManager) register(g *Group, weight float64) {
+	if weight <= 0 {
+		weight = 1
+	}
+	stats := g.Stats()
+	m.mu.Lock()
+	m.members[g] = &member{
+		weight:   weight,
+		maxBytes: g.CacheBytes(),
+		lastGets: stats.Gets,
+		lastHits: stats.CacheHits + stats.HotCacheHits,
+	}
+	m.mu.Unlock()
+	m.Rebalance()
+	if m.interval > 0 {
+		m.startOnce.Do(func() { go m.run() })
+	}
+}
+
+// unregister 停止管理 Group 其容量恢复为NewGroup的maxBytes 释放的份额分给其他 Group
+func (m *MemoryManager) unregister(g *Group) {
+	m.mu.Lock()
+	mb, ok := m.members[g]
+	delete(m.members, g)
+	m.mu.Unlock()
+	if ok {
+		g.cache.setMaxBytes(mb.maxBytes)
+		m.Rebalance()
+	}
+}
+
+// setMaxBytes 修改被管理的 Group 自己的容量上限并重新分配 Group未被管理时返回false
+func (m *MemoryManager) setMaxBytes(g *Group, n int64) bool {
+	m.mu.Lock()
+	mb, ok := m.members[g]
+	if ok {
+		mb.maxBytes = n
+	}
+	m.mu.Unlock()
+	if ok {
+		m.Rebalance()
+	}
+	return ok
+}
+
+// Rebalance 按权重和近期命中率重新分配各 Group 的容量
+// 先缩小再扩大 保证分配过程中总占用不超过limit
+func (m *MemoryManager) Rebalance() {
+	m.mu.Lock()
+	shares := m.shares()
+	m.mu.Unlock()
+	for g, share := range shares {
+		if share < g.cache.maxBytes() {
+			g.cache.setMaxBytes(share)
+		}
+	}
+	for g, share := range shares {
+		if share > g.cache.maxBytes() {
+			g.cache.setMaxBytes(share)
+		}
+	}
+}
+
+// shares 根据近期命中率计算各 Group 的份额 调用方需持有mu
+func (m *MemoryManager) shares() map[*Group]int64 {
+	var total float64
+	for g, mb := range m.members {
+		stats := g.Stats()
+		hits := stats.CacheHits + stats.HotCacheHits
+		// 这段时间没有Get时沿用之前的命中率
+		if gets := stats.Gets - mb.lastGets; gets > 0 {
+			mb.hitRate = float64(hits-mb.lastHits) / float64(gets)
+		}
+		mb.lastGets, mb.lastHits = stats.Gets, hits
+		total += mb.score()
+	}
+	shares := make(map[*Group]int64, len(m.members))
+	for g, mb := range m.members {
+		share := int64(float64(m.limit) * mb.score() / total)
+		if mb.maxBytes != 0 && share > mb.maxBytes {
+			share = mb.maxBytes
+		}
+		// 容量为0表示不限制 至少分配1字节
+		if share < 1 {
+			share = 1
+		}
+		shares[g] = share
+	}
+	return shares
+}
+
+// used 返回所有 Group 的cache占用之和 调用方需持有mu
+func (m *MemoryManager) used() int64 {
+	var used int64
+	for g := range m.members {
+		used += g.cache.usedBytes()
+	}
+	return used
+}
+
+// reclaim 在总占用超过limit时 从单位字节价值最低的 Group 淘汰超出的部分
+// 只淘汰不改变 Group 的容量 不会覆盖同时进行的Rebalance分配的容量
+func (m *MemoryManager) reclaim() {
+	if !m.reclaiming.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.reclaiming.Store(false)
+	for i := 0; ; i++ {
+		m.mu.RLock()
+		victim, excess := m.victim()
+		n := len(m.members)
+		m.mu.RUnlock()
+		if victim == nil || i >= n {
+			return
+		}
+		target := victim.cache.usedBytes() - excess
+		if target < 1 {
+			target = 1
+		}
+		victim.cache.shrink(target)
+	}
+}
+
+// victim 返回超出limit的字节数和单位字节价值最低的 Group 未超出时返回nil 调用方需持有mu
+func (m *MemoryManager) victim() (*Group, int64) {
+	excess := m.used() - m.limit
+	if excess <= 0 {
+		return nil, 0
+	}
+	var victim *Group
+	var lowest float64
+	for g, mb := range m.members {
+		used := g.cache.usedBytes()
+		if used == 0 {
+			continue
+		}
+		if value := mb.score() / float64(used); victim == nil || value < lowest {
+			victim, lowest = g, value
+		}
+	}
+	return victim, excess
+}
+
+// run 定期重新分配容量
+func (m *MemoryManager) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Rebalance()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Close 停止定期重新分配
+func (m *MemoryManager) Close() {
+	m.closeOnce.Do(func() { close(m.stop) })
+}
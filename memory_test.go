@@ -0,0 +1,204 @@
+package simplegroupcache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryManagerLimit(t *testing.T) {
+	m := NewMemoryManager(1000, 0)
+	defer m.Close()
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	a, err := NewGroup("memory-a", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-a")
+	b, err := NewGroup("memory-b", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-b")
+	if a.CacheBytes() != 500 || b.CacheBytes() != 500 {
+		t.Fatalf("expected equal shares, got %d and %d", a.CacheBytes(), b.CacheBytes())
+	}
+
+	for i := 0; i < 200; i++ {
+		a.Get(context.Background(), strconv.Itoa(i))
+		b.Get(context.Background(), strconv.Itoa(i))
+	}
+	if used := a.Stats().MainCache.Bytes + b.Stats().MainCache.Bytes; used > 1000 {
+		t.Fatalf("total bytes %d exceeds the shared limit", used)
+	}
+
+	// 绕过 MemoryManager 调大b的容量后 b超出其份额 单位字节价值最低 超出共享上限的部分从b淘汰
+	// 淘汰后b的容量保持不变 不需要等到下次Rebalance
+	bytesA := a.Stats().MainCache.Bytes
+	b.cache.setMaxBytes(10000)
+	for i := 200; i < 300; i++ {
+		b.Get(context.Background(), strconv.Itoa(i))
+	}
+	if used := a.Stats().MainCache.Bytes + b.Stats().MainCache.Bytes; used > 1000 || a.Stats().MainCache.Bytes != bytesA {
+		t.Fatalf("overflow should be reclaimed from b, total %d", used)
+	}
+	if b.CacheBytes() != 10000 {
+		t.Fatalf("reclaim should not shrink the capacity of b, got %d", b.CacheBytes())
+	}
+}
+
+func TestMemoryManagerSetCacheBytes(t *testing.T) {
+	m := NewMemoryManager(1000, 0)
+	defer m.Close()
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	a, err := NewGroup("memory-set-a", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewGroup("memory-set-b", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-set-b")
+
+	// 手动设置的上限在重新分配后依然有效
+	a.SetCacheBytes(200)
+	m.Rebalance()
+	if a.CacheBytes() != 200 || b.CacheBytes() != 500 {
+		t.Fatalf("manual limit should survive rebalance, got %d and %d", a.CacheBytes(), b.CacheBytes())
+	}
+	// 不再被管理后恢复为手动设置的上限
+	DestroyGroup("memory-set-a")
+	if a.CacheBytes() != 200 || b.CacheBytes() != 1000 {
+		t.Fatalf("expected 200 and 1000 after unregister, got %d and %d", a.CacheBytes(), b.CacheBytes())
+	}
+}
+
+func TestMemoryManagerReclaimKeepsCapacity(t *testing.T) {
+	m := NewMemoryManager(1000, 0)
+	defer m.Close()
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	a, err := NewGroup("memory-race-a", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-race-a")
+	b, err := NewGroup("memory-race-b", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-race-b")
+
+	// reclaim与重新分配同时进行 reclaim不能把容量改回它开始时看到的值
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			a.SetCacheBytes(int64(300 + i%2*9700))
+		}
+		a.SetCacheBytes(300)
+	}()
+	for i := 0; i < 1000; i++ {
+		a.Get(context.Background(), strconv.Itoa(i))
+		b.Get(context.Background(), strconv.Itoa(i))
+	}
+	<-done
+	if a.CacheBytes() != 300 {
+		t.Fatalf("expected the capacity of a to be 300, got %d", a.CacheBytes())
+	}
+}
+
+func TestMemoryManagerListener(t *testing.T) {
+	m := NewMemoryManager(1000, 0)
+	defer m.Close()
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	var a *Group
+	calls := 0
+	listener := func(key string, value ByteView, reason EvictReason) {
+		// 淘汰时监听者再访问被管理的 Group 不会死锁
+		a.CacheBytes()
+		if calls++; calls == 1 {
+			a.Get(context.Background(), "again")
+		}
+	}
+	a, err := NewGroup("memory-listener", 10000, "lru", retriever,
+		WithMemoryManager(m, 1), WithEvictionListener(listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-listener")
+	for i := 0; i < 100; i++ {
+		a.Get(context.Background(), strconv.Itoa(i))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// 新的 Group 加入时重新分配 a的容量缩小并触发淘汰
+		NewGroup("memory-listener-b", 10000, "lru", retriever, WithMemoryManager(m, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("listener deadlocked during rebalance")
+	}
+	defer DestroyGroup("memory-listener-b")
+	if calls == 0 || a.CacheBytes() != 500 {
+		t.Fatalf("rebalance should evict from a, got %d calls", calls)
+	}
+}
+
+func TestMemoryManagerRebalance(t *testing.T) {
+	m := NewMemoryManager(1000, 0)
+	defer m.Close()
+	retriever := RetrieverFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	hot, err := NewGroup("memory-hot", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-hot")
+	cold, err := NewGroup("memory-cold", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-cold")
+
+	// hot总是命中 cold总是未命中
+	for i := 0; i < 100; i++ {
+		hot.Get(context.Background(), "Tom")
+		cold.Get(context.Background(), strconv.Itoa(i))
+	}
+	m.Rebalance()
+	if hot.CacheBytes() <= cold.CacheBytes() || hot.CacheBytes()+cold.CacheBytes() > 1000 {
+		t.Fatalf("hot group should get a larger share, got %d and %d", hot.CacheBytes(), cold.CacheBytes())
+	}
+
+	DestroyGroup("memory-hot")
+	DestroyGroup("memory-cold")
+
+	// 命中率相同时按权重分配
+	heavy, err := NewGroup("memory-heavy", 10000, "lru", retriever, WithMemoryManager(m, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-heavy")
+	light, err := NewGroup("memory-light", 10000, "lru", retriever, WithMemoryManager(m, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DestroyGroup("memory-light")
+	if heavy.CacheBytes() != 750 || light.CacheBytes() != 250 {
+		t.Fatalf("expected shares by weight, got %d and %d", heavy.CacheBytes(), light.CacheBytes())
+	}
+}
@@ -3,54 +3,368 @@ package simplegroupcache
 // cache 模块负责提供对lru模块的并发控制
 
 import (
+	"fmt"
 	cachestrategy "simple-groupcache/cache-strategy"
-	"simple-groupcache/cache-strategy/arc"
-	"simple-groupcache/cache-strategy/lfu"
-	"simple-groupcache/cache-strategy/lru"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	// 内置的缓存策略在init时注册自己
+	_ "simple-groupcache/cache-strategy/arc"
+	_ "simple-groupcache/cache-strategy/lfu"
+	_ "simple-groupcache/cache-strategy/lru"
+	_ "simple-groupcache/cache-strategy/tinylfu"
 )
 
+// defaultCacheStrategy 未指定缓存策略时使用lru
+const defaultCacheStrategy = "lru"
+
 // 这样设计可以进行mutexCache和算法的分离，比如我现在实现了lfu缓存模块
 // 只需替换mutexCache成员即可
+// 由于lru/lfu的Get也会修改内部链表 一把锁会使所有Get串行执行
+// 因此mutexCache按key的哈希值分为多个分片 每个分片有自己的锁和缓存策略实例
 type mutexCache struct {
-	mu       sync.Mutex
-	cache    cachestrategy.CacheStrategy
-	capacity int64 // 缓存最大容量
-}
-
-func newCache(capacity int64, cacheStrategy string) *mutexCache {
-	var cache cachestrategy.CacheStrategy
-	switch cacheStrategy {
-	case "lru":
-		cache = lru.New(capacity, nil)
-	case "lfu":
-		cache = lfu.New(capacity, nil)
-	case "arc":
-		cache = arc.New(capacity, nil)
-	default:
-		cache = lru.New(capacity, nil)
+	shards   []*cacheShard
+	limitsMu sync.Mutex           // 保证并发修改容量上限时各分片一致
+	limits   cachestrategy.Limits // 缓存的容量上限 各分片平分
+
+	evictions atomic.Int64       // 累计淘汰数(容量不足或过期) 由策略的OnEvicted回调更新
+	listeners []EvictionListener // 缓存被移出时的监听者 创建后不再修改
+	// used 是所有分片计入容量的字节数之和 与limits.MaxBytes口径一致
+	// 用原子变量维护 这样MemoryManager不必锁住所有分片就能读取
+	used           atomic.Int64
+	chargeOverhead atomic.Bool
+
+	reapInterval time.Duration // 后台清理过期缓存的间隔 0表示不启动后台清理
+	reapOnce     sync.Once     // 后台清理在第一次写入带过期时间的缓存时才启动
+	stop         chan struct{} // 通知后台清理协程退出
+	closeOnce    sync.Once
+}
+
+// cacheShard 是mutexCache的一个分片
+type cacheShard struct {
+	mu      sync.Mutex
+	cache   cachestrategy.CacheStrategy
+	used    int64           // 上次track时分片计入容量的字节数
+	removed int64           // 分片累计移出的缓存条数 用于判断一次读取是否改变了占用
+	events  []evictionEvent // 持有锁期间产生的移出事件 释放锁后交给监听者
+}
+
+// evictionEvent 是一次缓存移出
+type evictionEvent struct {
+	key    string
+	value  ByteView
+	reason EvictReason
+}
+
+// newCache 使用以cacheStrategy注册的缓存策略创建有shards个分片的mutexCache
+// cacheStrategy为空时使用lru 未注册的缓存策略返回error
+// listeners 在缓存被移出时调用 调用时不持有分片的锁
+func newCache(capacity int64, cacheStrategy string, shards int, listeners ...EvictionListener) (*mutexCache, error) {
+	if cacheStrategy == "" {
+		cacheStrategy = defaultCacheStrategy
 	}
+	factory, ok := cachestrategy.Lookup(cacheStrategy)
+	if !ok {
+		return nil, fmt.Errorf("unknown cache strategy %q, registered: %v", cacheStrategy, cachestrategy.Names())
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	c := newCacheWith(nil, capacity)
+	c.listeners = listeners
+	c.shards = make([]*cacheShard, shards)
+	for i := range c.shards {
+		s := &cacheShard{}
+		s.cache = factory(shardCapacity(capacity, shards, i), func(key string, value cachestrategy.Lengthable, reason EvictReason) {
+			c.onEvicted(s, key, value, reason)
+		})
+		c.shards[i] = s
+	}
+	return c, nil
+}
+
+// newCacheWith 使用已创建好的缓存策略实例创建只有一个分片的mutexCache
+// 由于实例的淘汰回调由创建者决定 这样创建的mutexCache不统计淘汰数 也没有监听者
+func newCacheWith(cache cachestrategy.CacheStrategy, capacity int64) *mutexCache {
 	return &mutexCache{
-		cache:    cache,
-		capacity: capacity,
+		shards:       []*cacheShard{{cache: cache}},
+		limits:       cachestrategy.Limits{MaxBytes: capacity},
+		reapInterval: defaultReapInterval,
+		stop:         make(chan struct{}),
+	}
+}
+
+// setLimits 设置容量上限 字节数和条目数由各分片平分
+// 超出新上限的缓存会立即被各分片的缓存策略淘汰 释放limitsMu后再通知监听者
+func (c *mutexCache) setLimits(limits cachestrategy.Limits) {
+	c.limitsMu.Lock()
+	events := c.applyLimits(limits)
+	c.limitsMu.Unlock()
+	c.dispatch(events)
+}
+
+// setMaxBytes 只修改字节数上限 其余上限保持不变
+func (c *mutexCache) setMaxBytes(maxBytes int64) {
+	c.limitsMu.Lock()
+	limits := c.limits
+	limits.MaxBytes = maxBytes
+	events := c.applyLimits(limits)
+	c.limitsMu.Unlock()
+	c.dispatch(events)
+}
+
+// shrink 淘汰缓存直到占用不超过target 容量上限保持不变
+// 在limitsMu内先按target应用再恢复原上限 与并发的setMaxBytes互不覆盖
+func (c *mutexCache) shrink(target int64) {
+	c.limitsMu.Lock()
+	limits := c.limits
+	shrunk := limits
+	shrunk.MaxBytes = target
+	events := c.applyLimits(shrunk)
+	events = append(events, c.applyLimits(limits)...)
+	c.limitsMu.Unlock()
+	c.dispatch(events)
+}
+
+// applyLimits 将容量上限平分到各分片 调用方需持有limitsMu
+// 返回期间产生的移出事件 由调用方释放limitsMu后交给监听者
+func (c *mutexCache) applyLimits(limits cachestrategy.Limits) []evictionEvent {
+	var events []evictionEvent
+	c.limits = limits
+	c.chargeOverhead.Store(limits.ChargeOverhead)
+	for i, s := range c.shards {
+		l := limits
+		l.MaxBytes = shardCapacity(limits.MaxBytes, len(c.shards), i)
+		l.MaxEntries = shardCapacity(limits.MaxEntries, len(c.shards), i)
+		// 条目数的上限被平分到0时 该分片至少也要能放1条 否则会变成不限制
+		if limits.MaxEntries != 0 && l.MaxEntries == 0 {
+			l.MaxEntries = 1
+		}
+		s.mu.Lock()
+		s.cache.SetLimits(l)
+		c.track(s)
+		events = append(events, c.release(s)...)
+	}
+	return events
+}
+
+// track 在持有分片锁时调用 将分片占用字节数的变化累计到used
+func (c *mutexCache) track(s *cacheShard) {
+	n := s.cache.Bytes()
+	if c.chargeOverhead.Load() {
+		n = s.cache.ResidentBytes()
+	}
+	if n == s.used {
+		return
+	}
+	c.used.Add(n - s.used)
+	s.used = n
+}
+
+// usedBytes 返回当前计入容量的字节数
+func (c *mutexCache) usedBytes() int64 {
+	return c.used.Load()
+}
+
+// maxBytes 返回当前的字节数上限
+func (c *mutexCache) maxBytes() int64 {
+	c.limitsMu.Lock()
+	defer c.limitsMu.Unlock()
+	return c.limits.MaxBytes
+}
+
+// setAging 为每个分片设置频率衰减 访问次数由各分片平分
+// 缓存策略不支持频率衰减时返回error
+func (c *mutexCache) setAging(ops int64, period time.Duration) error {
+	for i, s := range c.shards {
+		ager, ok := s.cache.(cachestrategy.Ager)
+		if !ok {
+			return fmt.Errorf("cache strategy %T does not support aging", s.cache)
+		}
+		n := shardCapacity(ops, len(c.shards), i)
+		if ops != 0 && n == 0 {
+			n = 1
+		}
+		s.mu.Lock()
+		ager.SetAging(n, period)
+		s.mu.Unlock()
 	}
+	return nil
 }
 
-func (c *mutexCache) add(key string, value ByteView) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.cache.Add(key, value)
+// shardCapacity 计算第i个分片的容量 余数分给前面的分片
+func shardCapacity(capacity int64, shards int, i int) int64 {
+	n := capacity / int64(shards)
+	if int64(i) < capacity%int64(shards) {
+		n++
+	}
+	return n
+}
+
+// shard 根据key的哈希值(FNV-1a)选择分片
+func (c *mutexCache) shard(key string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// onEvicted 策略移出缓存时的回调 此时已持有分片s的锁
+// 监听者可能很慢或者再访问缓存 所以这里只记录事件 等释放锁后再调用监听者
+func (c *mutexCache) onEvicted(s *cacheShard, key string, value cachestrategy.Lengthable, reason EvictReason) {
+	s.removed++
+	if reason == cachestrategy.EvictCapacity || reason == cachestrategy.EvictExpired {
+		c.evictions.Add(1)
+	}
+	if len(c.listeners) > 0 {
+		s.events = append(s.events, evictionEvent{key: key, value: value.(ByteView), reason: reason})
+	}
+}
+
+// unlock 释放分片的锁 并在锁外将期间产生的移出事件交给监听者
+func (c *mutexCache) unlock(s *cacheShard) {
+	c.dispatch(c.release(s))
+}
+
+// release 释放分片的锁 返回持有锁期间产生的移出事件
+func (c *mutexCache) release(s *cacheShard) []evictionEvent {
+	events := s.events
+	s.events = nil
+	s.mu.Unlock()
+	return events
+}
+
+// dispatch 将移出事件交给监听者 调用时不能持有cache的任何锁
+func (c *mutexCache) dispatch(events []evictionEvent) {
+	for _, e := range events {
+		for _, listener := range c.listeners {
+			listener(e.key, e.value, e.reason)
+		}
+	}
+}
+
+// add 添加缓存 expire为零值表示永不过期
+func (c *mutexCache) add(key string, value ByteView, expire time.Time) {
+	s := c.shard(key)
+	s.mu.Lock()
+	s.cache.Add(key, value, expire)
+	c.track(s)
+	c.unlock(s)
+	if !expire.IsZero() && c.reapInterval > 0 {
+		c.reapOnce.Do(func() { go c.reap() })
+	}
 }
 
 func (c *mutexCache) get(key string) (ByteView, bool) {
-	if c.cache == nil {
+	s := c.shard(key)
+	if s.cache == nil {
 		return ByteView{}, false
 	}
 	// 注意：Get操作需要修改lru中的双向链表，需要使用互斥锁。
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if v, ok := c.cache.Get(key); ok {
+	s.mu.Lock()
+	defer c.unlock(s)
+	removed := s.removed
+	v, ok := s.cache.Get(key)
+	// Get会惰性删除过期缓存 只有确实移出了缓存才需要更新占用 命中时不碰共享的计数
+	if s.removed != removed {
+		c.track(s)
+	}
+	if ok {
+		return v.(ByteView), true
+	}
+	return ByteView{}, false
+}
+
+// peek 获取缓存但不改变淘汰顺序 Peek不修改缓存 但仍需加锁防止与写入并发
+func (c *mutexCache) peek(key string) (ByteView, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.cache.Peek(key); ok {
 		return v.(ByteView), true
 	}
 	return ByteView{}, false
 }
+
+// keys 返回所有分片中value满足keep的key 分片内按淘汰顺序 分片之间依次拼接
+func (c *mutexCache) keys(keep func(value ByteView) bool) []string {
+	var keys []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.cache.Range(func(key string, value cachestrategy.Lengthable) bool {
+			if keep(value.(ByteView)) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		s.mu.Unlock()
+	}
+	return keys
+}
+
+func (c *mutexCache) remove(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer c.unlock(s)
+	s.cache.Remove(key)
+	c.track(s)
+}
+
+// stats 返回缓存当前的统计信息 即所有分片之和
+func (c *mutexCache) stats() CacheStats {
+	stats := CacheStats{Evictions: c.evictions.Load()}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Bytes += s.cache.Bytes()
+		stats.ResidentBytes += s.cache.ResidentBytes()
+		stats.Items += s.cache.Len()
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (c *mutexCache) setClock(clock cachestrategy.Clock) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.cache.SetClock(clock)
+		s.mu.Unlock()
+	}
+}
+
+// removeExpired 清理所有已过期的缓存 每次只锁住一个分片
+func (c *mutexCache) removeExpired() int {
+	count := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		count += s.cache.RemoveExpired()
+		c.track(s)
+		c.unlock(s)
+	}
+	return count
+}
+
+// reap 定期清理过期缓存 过期缓存在Get时也会被惰性删除
+// 后台清理用于回收那些过期后再也没被访问的缓存占用的内存
+func (c *mutexCache) reap() {
+	ticker := time.NewTicker(c.reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.removeExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close 停止后台清理协程
+func (c *mutexCache) close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+}
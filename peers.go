@@ -1,14 +1,35 @@
 package simplegroupcache
 
+import "context"
+
 // peers 模块
 
 // Picker 定义了获取分布式节点的能力
 type Picker interface {
-	PickPeer(key string) (Fetcher, bool)
+	// PickPeer 选出key的所属节点 ctx 供需要远程查询的实现控制deadline和取消
+	PickPeer(ctx context.Context, key string) (Fetcher, bool)
+	// Peers 返回除自身以外的所有远端节点 用于广播失效通知
+	Peers() []Fetcher
+}
+
+// FetchResult 是FetchMulti中单个key的结果
+type FetchResult struct {
+	Result
+	Err error
 }
 
-// Fetcher 定义了从远端获取缓存的能力
-// 所以每个Peer应实现这个接口
+// Fetcher 定义了访问远端节点缓存的能力
+// 所以每个Peer应实现这个接口 ctx 用于控制RPC调用的deadline和取消
 type Fetcher interface {
-	Fetch(group string, key string) ([]byte, error)
+	// Fetch 获取远端节点的缓存值 Result中还带有所属节点对缓存的要求(过期时间/是否缓存)
+	Fetch(ctx context.Context, group string, key string) (Result, error)
+	// FetchMulti 在一次RPC中获取远端节点的多个key 结果与keys一一对应
+	// 只有整个RPC失败时才返回error 单个key的错误记录在对应结果的Err中
+	FetchMulti(ctx context.Context, group string, keys []string) ([]FetchResult, error)
+	// Set 在远端节点(key的所属节点)写入缓存
+	Set(ctx context.Context, group string, key string, value []byte) error
+	// Remove 在远端节点(key的所属节点)删除缓存
+	Remove(ctx context.Context, group string, key string) error
+	// Invalidate 通知远端节点丢弃其持有的本地副本
+	Invalidate(ctx context.Context, group string, key string) error
 }
@@ -0,0 +1,249 @@
+package registry
+
+// etcd模块提供基于etcd的Registry实现
+// 节点以租约的方式注册 节点宕机后租约过期 其注册信息会被etcd自动删除
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/endpoints"
+)
+
+const (
+	defaultLeaseTTL = 5 * time.Second
+
+	// keepalive中断后重新注册的等待时间 每次失败翻倍 直到maxRegisterBackoff
+	minRegisterBackoff = 100 * time.Millisecond
+	maxRegisterBackoff = 10 * time.Second
+)
+
+var (
+	DefaultEtcdConfig = clientv3.Config{
+		Endpoints:   []string{"localhost:2379"},
+		DialTimeout: 5 * time.Second,
+	}
+)
+
+// EtcdRegistry 是基于etcd的Registry
+type EtcdRegistry struct {
+	cli      *clientv3.Client
+	leaseTTL time.Duration
+
+	mu     sync.Mutex
+	leases map[string]etcdLease // service/addr -> 租约
+}
+
+// etcdLease 记录一次注册所使用的租约 以及停止keepalive的方法
+type etcdLease struct {
+	id   clientv3.LeaseID
+	stop context.CancelFunc
+}
+
+var _ Registry = (*EtcdRegistry)(nil)
+
+// NewEtcd 创建一个连接到etcd的Registry
+// leaseTTL 为注册所用租约的过期时长 不大于0时使用默认的5秒
+// etcd租约以秒为单位 不足整秒的部分向上取整 因此最短为1秒
+func NewEtcd(config clientv3.Config, leaseTTL time.Duration) (*EtcdRegistry, error) {
+	cli, err := clientv3.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("create etcd client failed: %v", err)
+	}
+	if leaseTTL <= 0 {
+		leaseTTL = defaultLeaseTTL
+	}
+	if rem := leaseTTL % time.Second; rem != 0 {
+		leaseTTL += time.Second - rem
+	}
+	return &EtcdRegistry{
+		cli:      cli,
+		leaseTTL: leaseTTL,
+		leases:   make(map[string]etcdLease),
+	}, nil
+}
+
+// Client 返回Registry所使用的etcd client
+func (r *EtcdRegistry) Client() *clientv3.Client {
+	return r.cli
+}
+
+// etcdTarget 返回service下注册信息的key前缀
+// 以"/"结尾 否则按前缀匹配时cache会匹配到cache-staging等其他服务的节点
+func etcdTarget(service string) string {
+	return service + "/"
+}
+
+// Register 在租赁模式下注册一个服务至etcd 并在后台维持租约
+// 租约因故过期(例如与etcd长时间断开)时 后台会重新注册 直到Deregister或Close
+func (r *EtcdRegistry) Register(ctx context.Context, service string, addr string) error {
+	// 创建一个租约
+	resp, err := r.cli.Grant(ctx, int64(r.leaseTTL/time.Second))
+	if err != nil {
+		return fmt.Errorf("create lease failed: %v", err)
+	}
+	leaseId := resp.ID
+	// 注册服务
+	em, err := endpoints.NewManager(r.cli, etcdTarget(service))
+	if err != nil {
+		return err
+	}
+	key := etcdTarget(service) + addr
+	err = em.AddEndpoint(ctx, key, endpoints.Endpoint{Addr: addr}, clientv3.WithLease(leaseId))
+	if err != nil {
+		return fmt.Errorf("add etcd record failed: %v", err)
+	}
+	// 设置服务心跳检测
+	kaCtx, stop := context.WithCancel(context.Background())
+	ch, err := r.cli.KeepAlive(kaCtx, leaseId)
+	if err != nil {
+		stop()
+		return fmt.Errorf("set keepalive failed: %v", err)
+	}
+	r.mu.Lock()
+	// 重新注册期间被Deregister时ctx已被取消 不能再把注册加回去
+	if err := ctx.Err(); err != nil {
+		r.mu.Unlock()
+		stop()
+		r.cli.Revoke(context.Background(), leaseId)
+		return err
+	}
+	if old, ok := r.leases[key]; ok {
+		old.stop()
+	}
+	r.leases[key] = etcdLease{id: leaseId, stop: stop}
+	r.mu.Unlock()
+
+	log.Printf("[%s] register service ok\n", addr)
+	go r.keepAlive(kaCtx, ch, service, addr)
+	return nil
+}
+
+// keepAlive 消费keepalive的响应 channel关闭意味着keepalive停止
+// 不是因为Deregister/Close而停止时 说明租约已经过期 以退避的方式重新注册
+func (r *EtcdRegistry) keepAlive(ctx context.Context, ch <-chan *clientv3.LeaseKeepAliveResponse, service string, addr string) {
+	for range ch {
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("[%s] keep alive channel closed, register again", addr)
+	backoff := minRegisterBackoff
+	for {
+		// 使用ctx注册 这样Deregister可以中止重新注册 成功后新的注册有自己的keepAlive
+		err := r.Register(ctx, service, addr)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Printf("[%s] register again failed: %v, retry in %v", addr, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRegisterBackoff {
+			backoff = maxRegisterBackoff
+		}
+	}
+}
+
+// Deregister 停止维持租约并撤销它 撤销租约会删除对应的注册信息
+func (r *EtcdRegistry) Deregister(ctx context.Context, service string, addr string) error {
+	key := etcdTarget(service) + addr
+	r.mu.Lock()
+	lease, ok := r.leases[key]
+	delete(r.leases, key)
+	if ok {
+		// 在锁内停止 与重新注册互斥
+		lease.stop()
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	_, err := r.cli.Revoke(ctx, lease.id)
+	return err
+}
+
+// Resolve 返回当前注册在service下的所有节点地址
+func (r *EtcdRegistry) Resolve(ctx context.Context, service string) ([]string, error) {
+	em, err := endpoints.NewManager(r.cli, etcdTarget(service))
+	if err != nil {
+		return nil, err
+	}
+	eps, err := em.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(eps))
+	for _, ep := range eps {
+		addrs = append(addrs, ep.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// Watch 监听注册在service下的所有节点 节点加入或离开(包括租约过期)时发送当前全部节点地址
+func (r *EtcdRegistry) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	em, err := endpoints.NewManager(r.cli, etcdTarget(service))
+	if err != nil {
+		return nil, err
+	}
+	wch, err := em.NewWatchChannel(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("watch service %s failed: %v", service, err)
+	}
+	ch := make(chan []string, 1)
+	go func() {
+		defer close(ch)
+		// key(service/addr) -> addr
+		peers := make(map[string]string)
+		for updates := range wch {
+			for _, up := range updates {
+				switch up.Op {
+				case endpoints.Add:
+					peers[up.Key] = up.Endpoint.Addr
+				case endpoints.Delete:
+					delete(peers, up.Key)
+				}
+			}
+			addrs := make([]string, 0, len(peers))
+			for _, addr := range peers {
+				addrs = append(addrs, addr)
+			}
+			sort.Strings(addrs)
+			notify(ch, addrs)
+		}
+	}()
+	return ch, nil
+}
+
+// Close 撤销所有注册并关闭etcd client
+func (r *EtcdRegistry) Close() error {
+	r.mu.Lock()
+	leases := r.leases
+	r.leases = make(map[string]etcdLease)
+	for _, lease := range leases {
+		lease.stop()
+	}
+	r.mu.Unlock()
+	for _, lease := range leases {
+		r.cli.Revoke(context.Background(), lease.id)
+	}
+	return r.cli.Close()
+}
+
+// notify 向容量为1的channel发送最新的节点列表
+// 如果上一次的列表还未被取走 则用最新的列表替换它 这样发送方永远不会阻塞
+func notify(ch chan []string, addrs []string) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- addrs
+}
@@ -0,0 +1,93 @@
+package registry
+
+// memory模块提供进程内的Registry实现
+// 同一进程内的多个节点共享一个MemoryRegistry即可相互发现 主要用于测试
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryRegistry 是进程内的Registry 可以被并发使用
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	services map[string]map[string]struct{}        // service -> addr集合
+	watchers map[string]map[chan []string]struct{} // service -> 监听者
+}
+
+var _ Registry = (*MemoryRegistry)(nil)
+
+// NewMemory 创建一个空的进程内Registry
+func NewMemory() *MemoryRegistry {
+	return &MemoryRegistry{
+		services: make(map[string]map[string]struct{}),
+		watchers: make(map[string]map[chan []string]struct{}),
+	}
+}
+
+func (r *MemoryRegistry) Register(_ context.Context, service string, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.services[service]; !ok {
+		r.services[service] = make(map[string]struct{})
+	}
+	r.services[service][addr] = struct{}{}
+	r.broadcast(service)
+	return nil
+}
+
+func (r *MemoryRegistry) Deregister(_ context.Context, service string, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.services[service][addr]; !ok {
+		return nil
+	}
+	delete(r.services[service], addr)
+	r.broadcast(service)
+	return nil
+}
+
+func (r *MemoryRegistry) Resolve(_ context.Context, service string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addrs(service), nil
+}
+
+func (r *MemoryRegistry) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	r.mu.Lock()
+	if _, ok := r.watchers[service]; !ok {
+		r.watchers[service] = make(map[chan []string]struct{})
+	}
+	r.watchers[service][ch] = struct{}{}
+	ch <- r.addrs(service)
+	r.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		delete(r.watchers[service], ch)
+		close(ch)
+		r.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+// addrs 返回service下排好序的节点地址 调用方需持有r.mu
+func (r *MemoryRegistry) addrs(service string) []string {
+	addrs := make([]string, 0, len(r.services[service]))
+	for addr := range r.services[service] {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// broadcast 通知service的所有监听者 调用方需持有r.mu
+func (r *MemoryRegistry) broadcast(service string) {
+	addrs := r.addrs(service)
+	for ch := range r.watchers[service] {
+		notify(ch, addrs)
+	}
+}
@@ -0,0 +1,20 @@
+package registry
+
+// registry模块定义了服务注册与发现的能力
+// 节点通过Registry发布自己的地址 并发现集群中的其他节点
+// 提供了etcd/静态列表/进程内三种实现 后两者无需依赖etcd 便于部署和测试
+
+import "context"
+
+// Registry 定义了服务注册与发现的能力
+type Registry interface {
+	// Register 将addr注册到service下 注册会一直保持(例如维持租约)直到Deregister
+	Register(ctx context.Context, service string, addr string) error
+	// Deregister 撤销addr在service下的注册
+	Deregister(ctx context.Context, service string, addr string) error
+	// Resolve 返回当前注册在service下的所有节点地址
+	Resolve(ctx context.Context, service string) ([]string, error)
+	// Watch 监听service下的节点 首次监听以及每当节点加入或离开时 发送当前全部节点地址
+	// ctx被取消后channel会被关闭
+	Watch(ctx context.Context, service string) (<-chan []string, error)
+}
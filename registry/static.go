@@ -0,0 +1,47 @@
+package registry
+
+// static模块提供基于静态节点列表的Registry实现
+// 适用于节点固定且不需要自动发现的部署
+
+import (
+	"context"
+	"sort"
+)
+
+// StaticRegistry 总是返回一份固定的节点列表
+// 注册与撤销都是no-op 因为节点列表在创建时就已确定
+type StaticRegistry struct {
+	addrs []string
+}
+
+var _ Registry = (*StaticRegistry)(nil)
+
+// NewStatic 创建一个由addrs组成的静态Registry 所有service都解析为这些节点
+func NewStatic(addrs ...string) *StaticRegistry {
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+	return &StaticRegistry{addrs: sorted}
+}
+
+func (r *StaticRegistry) Register(context.Context, string, string) error {
+	return nil
+}
+
+func (r *StaticRegistry) Deregister(context.Context, string, string) error {
+	return nil
+}
+
+func (r *StaticRegistry) Resolve(context.Context, string) ([]string, error) {
+	return append([]string(nil), r.addrs...), nil
+}
+
+// Watch 立即发送静态节点列表 之后节点列表不会再变化
+func (r *StaticRegistry) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	ch <- append([]string(nil), r.addrs...)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
@@ -2,6 +2,7 @@ package simplegroupcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -24,36 +25,155 @@ import (
 const (
 	defaultAddr     = "127.0.0.1:6324"
 	defaultReplicas = 50
-)
+	defaultService  = "cache"
 
-var (
-	defaultEtcdConfig = clientv3.Config{
-		Endpoints:   []string{"localhost:2379"},
-		DialTimeout: 5 * time.Second,
-	}
+	// 监听意外中断后重新监听的等待时间 每次失败翻倍 直到maxWatchBackoff
+	minWatchBackoff = 100 * time.Millisecond
+	maxWatchBackoff = 10 * time.Second
 )
 
 // server 和 Group 是解耦合的 所以server要自己实现并发控制
 type server struct {
 	pb.UnimplementedGroupcacheServer
 
-	addr       string     // format: ip:port
-	status     bool       // true: running false: stop
-	stopSignal chan error // 通知registry revoke服务
-	mu         sync.Mutex
-	consHash   *consistenthash.Consistency // 一致性哈希
-	clients    map[string]*client          // 保存各个远端主机的client
+	addr        string                 // format: ip:port
+	status      bool                   // true: running false: stop
+	registry    registry.Registry      // 服务注册与发现
+	ownRegistry *registry.EtcdRegistry // server根据etcdConfig自己创建的registry 由server负责关闭
+	grpcServer  *grpc.Server
+	stopWatch   context.CancelFunc
+	mu          sync.Mutex
+	consHash    *consistenthash.Consistency // 一致性哈希
+	clients     map[string]*client          // 保存各个远端主机的client
+	manualPeers bool                        // 是否通过SetPeers手动配置了节点 此时忽略自动发现的结果
+	discovered  []string                    // 最近一次从registry自动发现的节点
+
+	replicas   int                     // 一致性哈希的虚拟节点个数
+	hash       consistenthash.HashFunc // 一致性哈希的哈希函数 nil表示使用crc32
+	etcdConfig clientv3.Config         // 未设置registry时 用于创建etcd registry
+	leaseTTL   time.Duration           // etcd注册租约的过期时长
+	rpcTimeout time.Duration           // 调用方未设置deadline时 访问远端节点的超时时间
+	serverOpts []grpc.ServerOption     // 创建grpc server的额外选项
+	dialOpts   []grpc.DialOption       // 连接远端节点的额外选项
+	service    string                  // 注册的服务名前缀
+}
+
+// ServerOption 用于配置 server 的可选项
+type ServerOption func(s *server)
+
+// WithRegistry 设置server所使用的服务注册与发现 默认使用本地etcd
+func WithRegistry(r registry.Registry) ServerOption {
+	return func(s *server) {
+		s.registry = r
+	}
+}
+
+// WithReplicas 设置一致性哈希中每个节点的虚拟节点个数
+func WithReplicas(replicas int) ServerOption {
+	return func(s *server) {
+		s.replicas = replicas
+	}
+}
+
+// WithHashFunc 设置一致性哈希所使用的哈希函数
+func WithHashFunc(fn consistenthash.HashFunc) ServerOption {
+	return func(s *server) {
+		s.hash = fn
+	}
+}
+
+// WithEtcd 设置etcd的地址/认证信息等配置 仅在未通过WithRegistry设置registry时生效
+func WithEtcd(config clientv3.Config) ServerOption {
+	return func(s *server) {
+		s.etcdConfig = config
+	}
+}
+
+// WithLeaseTTL 设置注册至etcd时租约的过期时长 仅在未通过WithRegistry设置registry时生效
+// etcd租约以秒为单位 不足整秒时向上取整
+func WithLeaseTTL(ttl time.Duration) ServerOption {
+	return func(s *server) {
+		s.leaseTTL = ttl
+	}
+}
+
+// WithRPCTimeout 设置调用方未设置deadline时 访问远端节点的超时时间
+func WithRPCTimeout(timeout time.Duration) ServerOption {
+	return func(s *server) {
+		s.rpcTimeout = timeout
+	}
+}
+
+// WithGRPCServerOptions 设置创建grpc server时的额外选项 例如TLS证书
+func WithGRPCServerOptions(opts ...grpc.ServerOption) ServerOption {
+	return func(s *server) {
+		s.serverOpts = append(s.serverOpts, opts...)
+	}
+}
+
+// WithDialOptions 设置连接远端节点时的额外选项
+// 默认使用insecure连接 设置了传输凭证时以设置的为准
+func WithDialOptions(opts ...grpc.DialOption) ServerOption {
+	return func(s *server) {
+		s.dialOpts = append(s.dialOpts, opts...)
+	}
+}
+
+// WithServiceName 设置注册与发现节点时使用的服务名 默认为cache
+// 不同服务名的节点互相不可见 因此可以在同一个registry中部署多个集群
+func WithServiceName(service string) ServerOption {
+	return func(s *server) {
+		s.service = service
+	}
 }
 
 // NewServer 创建cache的svr 若addr为空 则使用defaultAddr
-func NewServer(addr string) (*server, error) {
+func NewServer(addr string, opts ...ServerOption) (*server, error) {
 	if addr == "" {
 		addr = defaultAddr
 	}
 	if !validPeerAddr(addr) {
 		return nil, fmt.Errorf("invalid addr %s, it should be x.x.x.x:port", addr)
 	}
-	return &server{addr: addr}, nil
+	s := &server{
+		addr:       addr,
+		replicas:   defaultReplicas,
+		etcdConfig: registry.DefaultEtcdConfig,
+		rpcTimeout: defaultRPCTimeout,
+		service:    defaultService,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.registry == nil {
+		if err := s.openRegistry(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// openRegistry 根据etcdConfig创建etcd registry 调用方需持有s.mu或独占server
+func (s *server) openRegistry() error {
+	r, err := registry.NewEtcd(s.etcdConfig, s.leaseTTL)
+	if err != nil {
+		return err
+	}
+	s.registry = r
+	s.ownRegistry = r
+	return nil
+}
+
+// closeRegistry 关闭server自己创建的registry及其etcd client 调用方需持有s.mu
+// 通过WithRegistry传入的registry由调用方负责关闭
+func (s *server) closeRegistry() {
+	if s.ownRegistry == nil {
+		return
+	}
+	if err := s.ownRegistry.Close(); err != nil {
+		log.Printf("[%s] close registry failed: %v", s.addr, err)
+	}
+	s.registry, s.ownRegistry = nil, nil
 }
 
 // 实现service的Get接口
@@ -69,11 +189,91 @@ func (s *server) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, e
 	if g == nil {
 		return resp, fmt.Errorf("group not found")
 	}
-	view, err := g.Get(key)
+	g.stats.serverRequests.Add(1)
+	view, err := g.Get(ctx, key)
 	if err != nil {
 		return resp, err
 	}
 	resp.Value = view.ByteSlice()
+	resp.Expire = expireNano(view.expire)
+	resp.NoStore = view.noStore
+	resp.Version = view.version
+	return resp, nil
+}
+
+// 实现service的GetMulti接口 结果与请求的keys一一对应
+func (s *server) GetMulti(ctx context.Context, in *pb.GetMultiRequest) (*pb.GetMultiResponse, error) {
+	group, keys := in.GetGroup(), in.GetKeys()
+	resp := &pb.GetMultiResponse{}
+
+	log.Printf("[cache_svr %s] Recv RPC GetMulti - (%s)/(%d keys)", s.addr, group, len(keys))
+	g := GetGroup(group)
+	if g == nil {
+		return resp, fmt.Errorf("group not found")
+	}
+	g.stats.serverRequests.Add(1)
+	results := g.GetMulti(ctx, keys)
+	resp.Results = make([]*pb.GetMultiResult, len(keys))
+	for i, key := range keys {
+		res := results[key]
+		r := &pb.GetMultiResult{Key: key}
+		if res.Err != nil {
+			r.Error = res.Err.Error()
+			r.NotFound = errors.Is(res.Err, ErrNotFound)
+		} else {
+			r.Value = res.Value.ByteSlice()
+			r.Expire = expireNano(res.Value.expire)
+			r.NoStore = res.Value.noStore
+			r.Version = res.Value.version
+		}
+		resp.Results[i] = r
+	}
+	return resp, nil
+}
+
+// 实现service的Set接口 本节点作为key的所属节点写入缓存
+func (s *server) Set(ctx context.Context, in *pb.SetRequest) (*pb.SetResponse, error) {
+	group, key := in.GetGroup(), in.GetKey()
+	resp := &pb.SetResponse{}
+
+	log.Printf("[cache_svr %s] Recv RPC Set - (%s)/(%s)", s.addr, group, key)
+	if key == "" {
+		return resp, fmt.Errorf("key required")
+	}
+	g := GetGroup(group)
+	if g == nil {
+		return resp, fmt.Errorf("group not found")
+	}
+	return resp, g.setLocally(ctx, key, in.GetValue())
+}
+
+// 实现service的Remove接口 本节点作为key的所属节点删除缓存
+func (s *server) Remove(ctx context.Context, in *pb.RemoveRequest) (*pb.RemoveResponse, error) {
+	group, key := in.GetGroup(), in.GetKey()
+	resp := &pb.RemoveResponse{}
+
+	log.Printf("[cache_svr %s] Recv RPC Remove - (%s)/(%s)", s.addr, group, key)
+	if key == "" {
+		return resp, fmt.Errorf("key required")
+	}
+	g := GetGroup(group)
+	if g == nil {
+		return resp, fmt.Errorf("group not found")
+	}
+	return resp, g.removeLocally(ctx, key)
+}
+
+// 实现service的Invalidate接口 丢弃本节点持有的副本
+func (s *server) Invalidate(ctx context.Context, in *pb.InvalidateRequest) (*pb.InvalidateResponse, error) {
+	group, key := in.GetGroup(), in.GetKey()
+	resp := &pb.InvalidateResponse{}
+
+	log.Printf("[cache_svr %s] Recv RPC Invalidate - (%s)/(%s)", s.addr, group, key)
+	g := GetGroup(group)
+	if g == nil {
+		return resp, fmt.Errorf("group not found")
+	}
+	g.invalidate(key)
 	return resp, nil
 }
 
@@ -84,77 +284,155 @@ func (s *server) Start() error {
 		s.mu.Unlock()
 		return fmt.Errorf("server already started")
 	}
-	// 1. 设置status为true 表示服务器已在运行
-	s.status = true
-	// 2. 初始化stop channal,这用于通知registry停止keepalive
-	s.stopSignal = make(chan error)
-
+	// Stop时关闭了自己创建的registry 重新启动时再创建
+	if s.registry == nil {
+		if err := s.openRegistry(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
 	port := strings.Split(s.addr, ":")[1]
-	// 3. 初始化tcp socket并开始监听
+	// 1. 初始化tcp socket并开始监听
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
+		s.mu.Unlock()
 		return fmt.Errorf("failed to listen: %v", err)
 	}
-	// 4. 启动grpc服务,注册rpc服务至grpc 这样grpc收到request可以分发给server处理
-	grpcServer := grpc.NewServer()
+	// 2. 启动grpc服务,注册rpc服务至grpc 这样grpc收到request可以分发给server处理
+	grpcServer := grpc.NewServer(s.serverOpts...)
 	pb.RegisterGroupcacheServer(grpcServer, s)
 
-	// 注册服务/撤销服务
-	go func() {
-		// 5. 将自己的服务名/Host地址注册至etcd 这样client可以通过etcd找到其他节点
-		// Register服务会一直阻塞 阻塞即意味着在此期间节点注册成功,可以被发现
-		err := registry.Register("cache", s.addr, s.stopSignal)
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-		// 撤销服务 关闭channel和tcp socket
-		close(s.stopSignal)
-		err = lis.Close()
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-		log.Printf("[%s] Revoke service and close tcp socket ok.", s.addr)
-	}()
+	// 3. 将自己的服务名/Host地址注册至registry 这样其他节点可以发现自己
+	// 注册会一直保持 直到Stop时撤销
+	if err := s.registry.Register(context.Background(), s.service, s.addr); err != nil {
+		lis.Close()
+		s.mu.Unlock()
+		return fmt.Errorf("register service failed: %v", err)
+	}
 
+	// 4. 监听registry中注册的节点 节点加入或离开时自动更新一致性哈希
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	s.stopWatch = stopWatch
+	go s.watchPeers(watchCtx)
+
+	// 5. 设置status为true 表示服务器已在运行
+	s.status = true
+	s.grpcServer = grpcServer
 	s.mu.Unlock()
-	// 6. 启动grpc服务
-	if err := grpcServer.Serve(lis); s.status && err != nil {
+	// 6. 启动grpc服务 Stop时grpcServer会关闭tcp socket 此时Serve返回
+	if err := grpcServer.Serve(lis); err != nil {
 		return fmt.Errorf("failed to serve: %v", err)
 	}
 	return nil
 }
 
+// watchPeers 监听registry中注册的节点 并据此重建一致性哈希和client
+// 通过SetPeers手动配置节点后 自动发现的结果将被忽略
+// 监听失败或channel被关闭(例如etcd连接中断)时 只要server还在运行就退避后重新监听
+func (s *server) watchPeers(ctx context.Context) {
+	backoff := minWatchBackoff
+	for {
+		ch, err := s.registry.Watch(ctx, s.service)
+		if err != nil {
+			log.Printf("[%s] watch peers failed: %v", s.addr, err)
+		} else {
+			for addrs := range ch {
+				// 收到过节点列表说明监听正常 重置等待时间
+				backoff = minWatchBackoff
+				s.discover(addrs)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[%s] watch peers stopped, retry in %v", s.addr, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// discover 用自动发现的节点重建一致性哈希和client
+func (s *server) discover(addrs []string) {
+	peersAddr := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if validPeerAddr(addr) {
+			peersAddr = append(peersAddr, addr)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discovered = peersAddr
+	if !s.manualPeers {
+		log.Printf("[%s] discover peers: %v", s.addr, peersAddr)
+		s.setPeers(peersAddr...)
+	}
+}
+
 // SetPeers 将各个远端主机IP配置到Server里
 // 这样Server就可以Pick他们了
+// 手动配置的节点会覆盖从registry自动发现的节点 不带参数调用则恢复自动发现
 // 注意: 此操作是*覆写*操作！
 // 注意: peersIP必须满足 x.x.x.x:port的格式
 func (s *server) SetPeers(peersAddr ...string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if len(peersAddr) == 0 {
+		s.manualPeers = false
+		s.setPeers(s.discovered...)
+		return
+	}
+	s.manualPeers = true
+	s.setPeers(peersAddr...)
+}
+
+// setPeers 重建一致性哈希和各个节点的client 调用方需持有s.mu
+func (s *server) setPeers(peersAddr ...string) {
 	// 初始化一致性哈希并注册各个节点
-	s.consHash = consistenthash.New(defaultReplicas, nil)
+	s.consHash = consistenthash.New(s.replicas, s.hash)
 	s.consHash.Register(peersAddr...)
-	// 初始化各个节点的client
-	s.clients = make(map[string]*client)
+	// 初始化各个节点的client 仍然存在的节点复用已有的client及其连接
+	clients := make(map[string]*client)
 	for _, peerAddr := range peersAddr {
 		if !validPeerAddr(peerAddr) {
 			panic(fmt.Sprintf("[peer %s] invalid address format, it should be x.x.x.x:port", peerAddr))
 		}
-		service := fmt.Sprintf("cache/%s", peerAddr)
-		s.clients[peerAddr] = NewClient(service)
+		if c, ok := s.clients[peerAddr]; ok {
+			clients[peerAddr] = c
+			continue
+		}
+		c := NewClient(s.service, peerAddr, s.registry)
+		c.timeout = s.rpcTimeout
+		c.dialOpts = s.dialOpts
+		clients[peerAddr] = c
+	}
+	// 关闭被移除节点的连接
+	for peerAddr, c := range s.clients {
+		if _, ok := clients[peerAddr]; !ok {
+			c.close()
+		}
 	}
+	s.clients = clients
 }
 
 // PickPeer 根据一致性哈希选举出key应存放在的节点
-// return nil,false 代表从本地获取cache
-func (s *server) PickPeer(key string) (Fetcher, bool) {
+// return nil,false 代表从本地获取cache 一致性哈希在本地计算 不需要使用ctx
+func (s *server) PickPeer(_ context.Context, key string) (Fetcher, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.consHash == nil {
+		return nil, false
+	}
 	peerAddr := s.consHash.GetPeer(key)
 	// Pick itself
-	if peerAddr == s.addr {
+	if peerAddr == "" || peerAddr == s.addr {
 		log.Printf("ooh! pick myself, I am %s\n", s.addr)
 		return nil, false
 	}
@@ -162,17 +440,43 @@ func (s *server) PickPeer(key string) (Fetcher, bool) {
 	return s.clients[peerAddr], true
 }
 
-// Stop 停止server运行 如果server没有运行 这将是一个no-op
+// Peers 返回除自身以外的所有远端节点
+func (s *server) Peers() []Fetcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]Fetcher, 0, len(s.clients))
+	for peerAddr, c := range s.clients {
+		if peerAddr != s.addr {
+			peers = append(peers, c)
+		}
+	}
+	return peers
+}
+
+// Stop 停止server运行 并关闭server自己创建的registry
+// 如果server没有运行 只会关闭registry
 func (s *server) Stop() {
 	s.mu.Lock()
 	if !s.status {
+		s.closeRegistry()
 		s.mu.Unlock()
 		return
 	}
-	s.stopSignal <- nil // 发送停止keepalive信号
-	s.status = false    // 设置server运行状态为stop
-	s.clients = nil     // 清空一致性哈希信息 有助于垃圾回收
+	s.stopWatch() // 停止监听节点变化
+	// 撤销服务 这样其他节点不会再发现自己
+	if err := s.registry.Deregister(context.Background(), s.service, s.addr); err != nil {
+		log.Printf("[%s] deregister service failed: %v", s.addr, err)
+	}
+	s.grpcServer.Stop() // 关闭grpc服务和tcp socket
+	log.Printf("[%s] Revoke service and close tcp socket ok.", s.addr)
+	s.status = false // 设置server运行状态为stop
+	for _, c := range s.clients {
+		c.close() // 关闭与各个节点的连接
+	}
+	s.clients = nil // 清空一致性哈希信息 有助于垃圾回收
 	s.consHash = nil
+	s.closeRegistry() // 关闭etcd client 停止租约的keepalive
 	s.mu.Unlock()
 }
 
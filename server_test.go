@@ -1,15 +1,21 @@
 package simplegroupcache
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"simple-groupcache/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func createTestSvr() (*Group, *server) {
+func createTestSvr(reg registry.Registry) (*Group, *server) {
 	db := map[string]string{
 		"Tom":  "630",
 		"Jack": "589",
@@ -17,7 +23,7 @@ func createTestSvr() (*Group, *server) {
 	}
 	cacheStrategy := "lru"
 
-	g := NewGroup("scores", 2<<10, cacheStrategy, RetrieverFunc(
+	g, err := NewGroup("scores", 2<<10, cacheStrategy, RetrieverFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[db] search key", key)
 			if v, ok := db[key]; ok {
@@ -25,30 +31,54 @@ func createTestSvr() (*Group, *server) {
 			}
 			return nil, fmt.Errorf("%s not exist", key)
 		}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	svr := createTestPeer(reg)
+	svr.SetPeers(svr.addr)
+	g.RegisterSvr(svr)
+	return g, svr
+}
 
+func createTestPeer(reg registry.Registry, opts ...ServerOption) *server {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	// 随机一个端口 避免冲突
-	port := 50000 + r.Intn(100)
+	port := 50000 + r.Intn(1000)
 	addr := fmt.Sprintf("localhost:%d", port)
 
-	svr, err := NewServer(addr)
+	svr, err := NewServer(addr, append([]ServerOption{WithRegistry(reg)}, opts...)...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	svr.SetPeers(addr)
-	g.RegisterSvr(svr)
-	return g, svr
+	return svr
 }
 
-func TestServer_GetExistsKey(t *testing.T) {
-	g, svr := createTestSvr()
+func startTestSvr(svr *server) {
 	go func() {
 		err := svr.Start()
 		if err != nil {
 			log.Fatal(err)
 		}
 	}()
-	view, err := g.Get("Tom")
+}
+
+// waitFor 轮询直到cond成立或超时
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_GetExistsKey(t *testing.T) {
+	g, svr := createTestSvr(registry.NewMemory())
+	startTestSvr(svr)
+	view, err := g.Get(context.Background(), "Tom")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,14 +90,9 @@ func TestServer_GetExistsKey(t *testing.T) {
 }
 
 func TestServer_GetUnknownKey(t *testing.T) {
-	g, svr := createTestSvr()
-	go func() {
-		err := svr.Start()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-	_, err := g.Get("Unknown")
+	g, svr := createTestSvr(registry.NewMemory())
+	startTestSvr(svr)
+	_, err := g.Get(context.Background(), "Unknown")
 	if err != nil {
 		if err.Error() != "Unknown not exist" {
 			t.Fatal(err)
@@ -77,3 +102,154 @@ func TestServer_GetUnknownKey(t *testing.T) {
 	}
 	DestroyGroup(g.name)
 }
+
+func TestServer_FetchFromPeer(t *testing.T) {
+	reg := registry.NewMemory()
+	g, svr := createTestSvr(reg)
+	startTestSvr(svr)
+	defer DestroyGroup(g.name)
+
+	c := NewClient(defaultService, svr.addr, reg)
+	defer c.close()
+	waitFor(t, func() bool {
+		addrs, _ := reg.Resolve(context.Background(), defaultService)
+		return len(addrs) == 1
+	})
+	for i := 0; i < 2; i++ {
+		res, err := c.Fetch(context.Background(), g.name, "Jack")
+		if err != nil || string(res.Value) != "589" {
+			t.Fatalf("failed to fetch Jack from peer: %v", err)
+		}
+	}
+	// close之后的调用直接失败 不会重新建立连接
+	c.close()
+	if _, err := c.Fetch(context.Background(), g.name, "Jack"); err == nil || c.conn != nil {
+		t.Fatalf("fetch after close should fail without redialing")
+	}
+	if _, err := NewClient(defaultService, "localhost:1", reg).Fetch(context.Background(), g.name, "Jack"); err == nil {
+		t.Fatalf("fetch from an unregistered peer should fail")
+	}
+}
+
+func TestServer_FetchMulti(t *testing.T) {
+	reg := registry.NewMemory()
+	g, svr := createTestSvr(reg)
+	startTestSvr(svr)
+	defer DestroyGroup(g.name)
+
+	c := NewClient(defaultService, svr.addr, reg)
+	defer c.close()
+	waitFor(t, func() bool {
+		addrs, _ := reg.Resolve(context.Background(), defaultService)
+		return len(addrs) == 1
+	})
+	results, err := c.FetchMulti(context.Background(), g.name, []string{"Tom", "Unknown", "Sam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(results[0].Value) != "630" || results[0].Err != nil || string(results[2].Value) != "567" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if results[1].Err == nil || results[1].Err.Error() != "Unknown not exist" {
+		t.Fatalf("expected error of Unknown, got %v", results[1].Err)
+	}
+}
+
+func TestServer_CloseOwnRegistry(t *testing.T) {
+	// 不设置DialTimeout时etcd client不会阻塞等待连接
+	svr, err := NewServer("localhost:50999", WithEtcd(clientv3.Config{Endpoints: []string{"127.0.0.1:1"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := svr.ownRegistry
+	if r == nil {
+		t.Fatalf("server should own the etcd registry it created")
+	}
+	svr.Stop()
+	if svr.ownRegistry != nil || r.Client().Ctx().Err() == nil {
+		t.Fatalf("stop should close the etcd registry created by the server")
+	}
+}
+
+func TestServer_DiscoverPeers(t *testing.T) {
+	reg := registry.NewMemory()
+	svrA, svrB := createTestPeer(reg), createTestPeer(reg)
+	for svrA.addr == svrB.addr {
+		svrB = createTestPeer(reg)
+	}
+	startTestSvr(svrA)
+	startTestSvr(svrB)
+
+	waitFor(t, func() bool { return len(svrA.Peers()) == 1 })
+	svrB.Stop()
+	waitFor(t, func() bool { return len(svrA.Peers()) == 0 })
+
+	// 手动配置的节点会覆盖自动发现的结果
+	svrA.SetPeers(svrA.addr, "localhost:1")
+	if len(svrA.Peers()) != 1 {
+		t.Fatalf("SetPeers should override discovered peers")
+	}
+	svrA.SetPeers()
+	if len(svrA.Peers()) != 0 {
+		t.Fatalf("SetPeers() should restore discovered peers")
+	}
+	svrA.Stop()
+}
+
+func TestServer_ServiceName(t *testing.T) {
+	reg := registry.NewMemory()
+	svrA := createTestPeer(reg, WithServiceName("cacheA"), WithReplicas(10), WithRPCTimeout(time.Second))
+	svrB := createTestPeer(reg, WithServiceName("cacheB"))
+	for svrA.addr == svrB.addr {
+		svrB = createTestPeer(reg, WithServiceName("cacheB"))
+	}
+	startTestSvr(svrA)
+	startTestSvr(svrB)
+	defer svrA.Stop()
+	defer svrB.Stop()
+
+	waitFor(t, func() bool {
+		addrs, _ := reg.Resolve(context.Background(), "cacheB")
+		return len(addrs) == 1
+	})
+	if len(svrA.Peers()) != 0 || len(svrB.Peers()) != 0 {
+		t.Fatalf("peers registered under different service names should not discover each other")
+	}
+}
+
+// flakyRegistry 的每次Watch发送一次节点列表后就关闭channel 模拟与etcd的连接中断
+type flakyRegistry struct {
+	registry.Registry
+	watches atomic.Int32
+}
+
+func (r *flakyRegistry) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	r.watches.Add(1)
+	ch := make(chan []string, 1)
+	ch <- []string{"localhost:1"}
+	close(ch)
+	return ch, nil
+}
+
+func TestServer_RewatchPeers(t *testing.T) {
+	reg := &flakyRegistry{Registry: registry.NewMemory()}
+	svr := createTestPeer(reg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svr.watchPeers(ctx)
+		close(done)
+	}()
+
+	// channel关闭后重新监听
+	waitFor(t, func() bool { return reg.watches.Load() >= 2 })
+	if len(svr.Peers()) != 1 {
+		t.Fatalf("expected peers from the watch, got %v", svr.Peers())
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("watchPeers should return after the server stops")
+	}
+}
@@ -0,0 +1,85 @@
+package simplegroupcache
+
+import "sync/atomic"
+
+// stats 模块记录 Group 的运行统计信息
+// 计数器均使用原子操作更新 Stats() 返回的是某一时刻的快照
+
+// groupStats Group 内部使用的计数器
+type groupStats struct {
+	gets           atomic.Int64 // Get请求数(包括来自远端节点的请求)
+	cacheHits      atomic.Int64 // cache命中数
+	hotCacheHits   atomic.Int64 // hotCache命中数
+	loads          atomic.Int64 // 未命中而需要加载的次数(singleflight去重前)
+	loadsDeduped   atomic.Int64 // singleflight去重后实际执行加载的次数
+	peerLoads      atomic.Int64 // 从远端节点加载成功的次数
+	peerErrors     atomic.Int64 // 从远端节点加载失败的次数
+	localLoads     atomic.Int64 // 从数据源加载成功的次数
+	localLoadErrs  atomic.Int64 // 从数据源加载失败的次数
+	serverRequests atomic.Int64 // 收到远端节点Get/GetMulti请求的次数
+	negativeHits   atomic.Int64 // 负缓存命中数
+	bloomRejects   atomic.Int64 // 被布隆过滤器拒绝的Get请求数
+	staleHits      atomic.Int64 // 返回变旧的值并触发后台刷新的次数
+	staleIfErrors  atomic.Int64 // 加载失败而返回过期旧值的次数
+	earlyRefreshes atomic.Int64 // 过期前被提前刷新的次数
+}
+
+// Stats 是 Group 统计信息的快照
+type Stats struct {
+	Gets           int64
+	CacheHits      int64
+	HotCacheHits   int64
+	Loads          int64
+	LoadsDeduped   int64
+	PeerLoads      int64
+	PeerErrors     int64
+	LocalLoads     int64
+	LocalLoadErrs  int64
+	ServerRequests int64
+	NegativeHits   int64
+	BloomRejects   int64
+	StaleHits      int64
+	StaleIfErrors  int64
+	EarlyRefreshes int64
+
+	MainCache     CacheStats
+	HotCache      CacheStats
+	NegativeCache CacheStats
+}
+
+// CacheStats 是单个缓存的统计信息
+type CacheStats struct {
+	Bytes         int64 // 当前占用的字节数 只计key+value
+	ResidentBytes int64 // 估计的实际内存占用 包括每条缓存的结构开销
+	Items         int64 // 当前缓存的条目数
+	Evictions     int64 // 累计淘汰的条目数
+}
+
+// Stats 返回 Group 当前统计信息的快照
+func (g *Group) Stats() Stats {
+	s := Stats{
+		Gets:           g.stats.gets.Load(),
+		CacheHits:      g.stats.cacheHits.Load(),
+		HotCacheHits:   g.stats.hotCacheHits.Load(),
+		Loads:          g.stats.loads.Load(),
+		LoadsDeduped:   g.stats.loadsDeduped.Load(),
+		PeerLoads:      g.stats.peerLoads.Load(),
+		PeerErrors:     g.stats.peerErrors.Load(),
+		LocalLoads:     g.stats.localLoads.Load(),
+		LocalLoadErrs:  g.stats.localLoadErrs.Load(),
+		ServerRequests: g.stats.serverRequests.Load(),
+		NegativeHits:   g.stats.negativeHits.Load(),
+		BloomRejects:   g.stats.bloomRejects.Load(),
+		StaleHits:      g.stats.staleHits.Load(),
+		StaleIfErrors:  g.stats.staleIfErrors.Load(),
+		EarlyRefreshes: g.stats.earlyRefreshes.Load(),
+		MainCache:      g.cache.stats(),
+	}
+	if g.hotCache != nil {
+		s.HotCache = g.hotCache.stats()
+	}
+	if g.negCache != nil {
+		s.NegativeCache = g.negCache.stats()
+	}
+	return s
+}
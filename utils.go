@@ -1,9 +1,100 @@
 package simplegroupcache
 
 import (
+	"context"
 	"strings"
+	"sync"
+	"time"
 )
 
+// sharedContext 是多个调用方共享的一次加载所使用的ctx
+// 它保留第一个调用方ctx中的值 deadline取所有等待者中最晚的一个(有等待者没有deadline时则没有)
+// 只有所有等待者都离开后才被取消 这样一个调用方超时或取消不会让其他调用方一起失败
+type sharedContext struct {
+	parent context.Context
+	done   chan struct{}
+
+	mu        sync.Mutex
+	waiters   int
+	deadline  time.Time
+	unbounded bool // 是否有等待者没有deadline
+	err       error
+}
+
+func newSharedContext(parent context.Context) *sharedContext {
+	return &sharedContext{parent: parent, done: make(chan struct{})}
+}
+
+// join 加入一个等待者 ctx已被取消时返回false
+func (c *sharedContext) join(ctx context.Context) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.waiters++
+	if d, ok := ctx.Deadline(); !ok {
+		c.unbounded = true
+	} else if d.After(c.deadline) {
+		c.deadline = d
+	}
+	return true
+}
+
+// leave 一个等待者离开 err为它离开的原因 最后一个等待者离开时取消ctx
+func (c *sharedContext) leave(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiters--
+	if c.waiters > 0 || c.err != nil {
+		return
+	}
+	if err == nil {
+		err = context.Canceled
+	}
+	c.err = err
+	close(c.done)
+}
+
+func (c *sharedContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.unbounded || c.deadline.IsZero() {
+		return time.Time{}, false
+	}
+	return c.deadline, true
+}
+
+func (c *sharedContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *sharedContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *sharedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+// expireNano 将过期时间转为unix纳秒以便在RPC中传递 零值(永不过期)转为0
+func expireNano(expire time.Time) int64 {
+	if expire.IsZero() {
+		return 0
+	}
+	return expire.UnixNano()
+}
+
+// expireTime 是expireNano的逆操作
+func expireTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
 // 判断是否满足 x.x.x.x:port 的格式
 func validPeerAddr(addr string) bool {
 	token1 := strings.Split(addr, ":")